@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	machinefile "github.com/gbraad-redhat/machinefile/pkg/machinefile"
+)
+
+// runExport converts a Containerfile into another format that applies it
+// without machinefile and returns the exit code
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "", "Output format: "+strings.Join(machinefile.ExportFormats, ", "))
+	output := flags.String("o", "", "Write the output to a file instead of stdout")
+	argValues := make(map[string]string)
+	flags.Func("arg", "Specify ARG values (format: --arg KEY=VALUE)", func(value string) error {
+		key, argValue, err := parseArgValue(value)
+		if err != nil {
+			return err
+		}
+		argValues[key] = argValue
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export --format=FORMAT [OPTIONS] CONTAINERFILE [CONTEXT]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nConvert a Containerfile to apply it without machinefile.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *format == "" || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	contextDir := getExecutionContext(path)
+	if flags.NArg() == 2 {
+		contextDir = flags.Arg(1)
+	}
+
+	df, err := machinefile.ReadDockerfile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	predefinedArgs := map[string]string{
+		"MACHINEFILE":     VERSION,
+		"BUILDKIT_SYNTAX": "",
+		"BUILD_DATE":      time.Now().UTC().Format(DATE_FORMAT),
+	}
+	for key, value := range argValues {
+		predefinedArgs[key] = value
+	}
+	options := machinefile.ExportOptions{
+		Source:     path,
+		ContextDir: contextDir,
+		Args:       predefinedArgs,
+		Version:    VERSION,
+		Warnings:   os.Stderr,
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := machinefile.Export(df, *format, options, w); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	machinefile "github.com/gbraad-redhat/machinefile/pkg/machinefile"
+)
+
+// printFacts gathers the facts of the target and writes them as JSON
+func printFacts(w io.Writer, runner machinefile.Runner) error {
+	facts, err := machinefile.GatherFacts(runner)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, facts)
+}
+
+// printFleetFacts writes the facts of all targets as a JSON object keyed by
+// host name and returns the number of hosts that could not be probed
+func printFleetFacts(targets []machinefile.FleetTarget) int {
+	failed := 0
+	hosts := make(map[string]*machinefile.Facts)
+	for _, target := range targets {
+		facts, err := machinefile.GatherFacts(target.Runner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error gathering facts of %s: %v\n", target.Name, err)
+			failed++
+			continue
+		}
+		hosts[target.Name] = facts
+	}
+	if err := writeJSON(os.Stdout, hosts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing facts: %v\n", err)
+		return len(targets)
+	}
+	return failed
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -11,6 +11,9 @@ var categories = []flagCategory{
 			"p",
 			"ssh",
 			"s",
+			"chroot",
+			"nspawn",
+			"nspawn-machine",
 		},
 	},
 	{
@@ -30,9 +33,33 @@ var categories = []flagCategory{
 			"user",
 			"u",
 			"key",
+			"cert",
+			"forward-agent",
+			"no-agent",
 			"password",
 			"ask-password",
 			"port",
+			"jump",
+			"ssh-config",
+		},
+	},
+	{
+		name: "Privilege Escalation",
+		flags: []string{
+			"become",
+			"become-method",
+			"ask-become-password",
+		},
+	},
+	{
+		name: "Inventory Options",
+		flags: []string{
+			"inventory",
+			"limit",
+			"forks",
+			"serial",
+			"max-fail-percentage",
+			"stop-on-failure",
 		},
 	},
 	{
@@ -44,11 +71,21 @@ var categories = []flagCategory{
 			"podman-binary",
 		},
 	},
+	{
+		name: "Machine Options",
+		flags: []string{
+			"install-service",
+			"healthcheck-timer",
+			"apply-expose",
+			"no-manifest",
+		},
+	},
 	{
 		name: "Other Options",
 		flags: []string{
 			"stdin",
 			"arg",
+			"dry-run",
 			"help",
 		},
 	},
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	machinefile "github.com/gbraad-redhat/machinefile/pkg/machinefile"
+)
+
+// runFormat formats Containerfiles, writing the result to stdout or back to
+// the files with -w, and returns the exit code
+func runFormat(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "Write the result to the file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fmt [-w] CONTAINERFILE...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nFormat Containerfiles in canonical form.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	exitCode := 0
+	for _, path := range flags.Args() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitCode = 1
+			continue
+		}
+		formatted, err := machinefile.Format(content)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error formatting %s: %v\n", path, err)
+			exitCode = 1
+			continue
+		}
+
+		if !*write {
+			os.Stdout.Write(formatted)
+			continue
+		}
+		if bytes.Equal(content, formatted) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exitCode = 1
+			continue
+		}
+		if err := os.WriteFile(path, formatted, info.Mode().Perm()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", path, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Fprintln(os.Stderr, path)
+	}
+	return exitCode
+}
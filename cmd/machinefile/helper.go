@@ -3,9 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	machinefile "github.com/gbraad-redhat/machinefile/pkg/machinefile"
+	"golang.org/x/term"
 )
 
 // Custom flag type that supports a primary name and shorthand
@@ -141,6 +146,43 @@ func parseUserHost(arg string) (string, string, bool) {
     return "", "", false
 }
 
+// isSSHAlias reports whether an argument names a Host from the ssh config
+// rather than a file
+func isSSHAlias(config *machinefile.SSHConfig, arg string) bool {
+	if strings.ContainsAny(arg, "/@") || !config.HasHost(arg) {
+		return false
+	}
+	_, err := os.Stat(arg)
+	return os.IsNotExist(err)
+}
+
+// resolveSSHUser returns the user to connect as, falling back to the User
+// from the ssh config and then the current user
+func resolveSSHUser(config *machinefile.SSHConfig, host, userName string) (string, error) {
+	if userName != "" {
+		return userName, nil
+	}
+	if configUser := config.Resolve(host).User; configUser != "" {
+		return configUser, nil
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return currentUser.Username, nil
+}
+
+// readPassword prompts for a password on the terminal without echoing it
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
 // normalizeFlag removes leading dashes from flag names
 func normalizeFlag(flag string) string {
 	return strings.TrimLeft(flag, "-")
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	machinefile "github.com/gbraad-redhat/machinefile/pkg/machinefile"
+)
+
+// runLint checks a Containerfile without running it and returns the exit
+// code: 1 when errors were found, or warnings with the check=error=true
+// parser directive
+func runLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	format := flags.String("format", "text", "Output format: text, json or sarif")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lint [--format=text|json|sarif] CONTAINERFILE [CONTEXT]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCheck a Containerfile for problems without running it.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+	contextDir := getExecutionContext(path)
+	if flags.NArg() == 2 {
+		contextDir = flags.Arg(1)
+	}
+
+	findings, df, err := machinefile.LintFile(path, contextDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	switch *format {
+	case "text":
+		writeLintText(os.Stdout, findings)
+	case "json":
+		if findings == nil {
+			findings = []machinefile.LintFinding{}
+		}
+		err = writeJSON(os.Stdout, findings)
+	case "sarif":
+		err = writeJSON(os.Stdout, newSarifLog(findings))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q, expected text, json or sarif\n", *format)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing findings: %v\n", err)
+		return 2
+	}
+
+	failOnWarning := df != nil && df.CheckError
+	for _, finding := range findings {
+		if finding.Severity == machinefile.SeverityError ||
+			(failOnWarning && finding.Severity == machinefile.SeverityWarning) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func writeLintText(w io.Writer, findings []machinefile.LintFinding) {
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s:%d: %s: [%s] %s\n", finding.File, finding.Line, finding.Severity, finding.Rule, finding.Message)
+	}
+}
+
+// SARIF 2.1.0 log, as read by code scanning tools
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+	DefaultConfig    sarifConfig  `json:"defaultConfiguration"`
+}
+
+type sarifConfig struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           sarifRegion   `json:"region"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+func newSarifLog(findings []machinefile.LintFinding) sarifLog {
+	driver := sarifDriver{
+		Name:           "machinefile",
+		Version:        VERSION,
+		InformationURI: "https://github.com/gbraad-redhat/machinefile",
+	}
+	for _, rule := range machinefile.LintRules {
+		driver.Rules = append(driver.Rules, sarifRule{
+			ID:               rule.ID,
+			ShortDescription: sarifMessage{rule.Description},
+			DefaultConfig:    sarifConfig{sarifLevel(rule.Severity)},
+		})
+	}
+
+	results := []sarifResult{}
+	for _, finding := range findings {
+		line := finding.Line
+		if line < 1 {
+			line = 1
+		}
+		results = append(results, sarifResult{
+			RuleID:  finding.Rule,
+			Level:   sarifLevel(finding.Severity),
+			Message: sarifMessage{finding.Message},
+			Locations: []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifact{filepath.ToSlash(finding.File)},
+					Region:           sarifRegion{line},
+				},
+			}},
+		})
+	}
+
+	return sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{{Tool: sarifTool{driver}, Results: results}},
+	}
+}
+
+func sarifLevel(severity string) string {
+	switch severity {
+	case machinefile.SeverityError:
+		return "error"
+	case machinefile.SeverityWarning:
+		return "warning"
+	}
+	return "note"
+}
@@ -3,8 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"os/user"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +18,24 @@ const(
 )
 
 func main() {
+	// Commands working on the Containerfile only have their own options
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(runLint(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(runFormat(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+
+	// Commands are given as the first argument, before any options
+	var command string
+	if len(os.Args) > 1 && os.Args[1] == "facts" {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// Help flag
 	helpRequested := new(bool)
 	helpFlag := newFlagWithShorthand("help", "h", newBoolValue(helpRequested), "Show usage message")
@@ -39,6 +58,10 @@ func main() {
 	flag.Var(sFlag.value, sFlag.name, sFlag.usage)
 	flag.Var(sFlag.value, sFlag.shorthand, sFlag.usage)
 
+	chrootDir := flag.String("chroot", "", "Select chroot runner for the given rootfs directory")
+	nspawnDir := flag.String("nspawn", "", "Select systemd-nspawn runner for the given rootfs directory")
+	nspawnMachine := flag.String("nspawn-machine", "", "Select systemd-nspawn runner for the given machine image")
+
 	// File and context flags with shorthands
 	dockerFile := new(string)
 	contextPath := new(string)
@@ -64,10 +87,23 @@ func main() {
 
 	// Other SSH flags
 	sshKeyPath := flag.String("key", "", "Path to SSH private key (optional)")
-	sshPort := flag.String("port", "22", "SSH port (optional)")
+	sshPort := flag.String("port", "", "SSH port (optional, defaults to the ssh config or 22)")
+	sshConfigPath := flag.String("ssh-config", "", "Path to OpenSSH client config (default ~/.ssh/config)")
+	sshCertPath := flag.String("cert", "", "Path to SSH certificate (optional, defaults to <key>-cert.pub)")
+	forwardAgent := flag.Bool("forward-agent", false, "Forward the ssh-agent to the target, e.g. to clone private repositories")
+	noAgent := flag.Bool("no-agent", false, "Do not authenticate using ssh-agent")
 	sshPassword := flag.String("password", "", "SSH password (optional)")
 	askPassword := flag.Bool("ask-password", false, "Prompt for SSH password")
+	var jumpHosts []string
+	flag.Func("jump", "SSH jump host user@host[:port], may be repeated or comma separated for chained jumps", func(value string) error {
+		jumpHosts = append(jumpHosts, value)
+		return nil
+	})
+	becomeEnabled := flag.Bool("become", false, "Run steps as root on the target, switching USER with the become method")
+	becomeMethod := flag.String("become-method", "sudo", "How to switch users: sudo, doas, su or none")
+	askBecomePassword := flag.Bool("ask-become-password", false, "Prompt once for the become password (or set MACHINEFILE_BECOME_PASSWORD)")
 	stdinMode := flag.Bool("stdin", false, "Read Dockerfile from stdin (used with shebang)")
+	dryRun := flag.Bool("dry-run", false, "Print the facts of the target and the steps that would run, without running them")
 
 	// Container-related flags
 	containerName := new(string)
@@ -79,6 +115,20 @@ func main() {
 	connection := flag.String("connection", "", "Podman connection name")
 	podmanBinary := flag.String("podman-binary", "podman", "Path to Podman binary")
 
+	// Inventory flags
+	inventoryPath := flag.String("inventory", "", "Path to an inventory file to run against multiple hosts")
+	limit := flag.String("limit", "", "Limit inventory to hosts or groups (comma separated, supports globs and !exclusions)")
+	forks := flag.Int("forks", 5, "Number of hosts to run in parallel")
+	serial := flag.String("serial", "", "Run inventory hosts in batches of N hosts or N% of hosts")
+	maxFailPercentage := flag.Int("max-fail-percentage", -1, "Halt when more than this percentage of a batch fails")
+	stopOnFailure := flag.Bool("stop-on-failure", false, "Halt as soon as any host fails")
+
+	// Machine flags
+	installService := flag.String("install-service", "", "Install the final ENTRYPOINT and CMD as a systemd service with the given name")
+	noManifest := flag.Bool("no-manifest", false, "Do not write the manifest of the run to /etc/machinefile/manifest.json on the target")
+	applyExpose := flag.Bool("apply-expose", false, "Open EXPOSE ports in the firewall of the target (firewalld or nftables)")
+	healthcheckTimer := flag.Bool("healthcheck-timer", false, "Also install the HEALTHCHECK as a systemd timer (requires --install-service)")
+
 	// ARG values
 	var args []string
 	flag.Func("arg", "Specify ARG values (format: -arg or --arg KEY=VALUE)", func(value string) error {
@@ -90,6 +140,10 @@ func main() {
 	// Custom usage message
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] [CONTAINERFILE] [CONTEXT]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s facts [OPTIONS] [TARGET]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lint [--format=text|json|sarif] CONTAINERFILE [CONTEXT]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s fmt [-w] CONTAINERFILE...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s export --format=FORMAT [OPTIONS] CONTAINERFILE [CONTEXT]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nMachinefile version: %s\n", VERSION)
 		
 		// Print each category
@@ -109,6 +163,12 @@ func main() {
 		fmt.Fprintf(os.Stderr, "\nPositional Arguments:\n")
 		fmt.Fprintf(os.Stderr, "  CONTAINERFILE  Path to the Containerfile/Dockerfile (can also be specified with -f, --file)\n")
 		fmt.Fprintf(os.Stderr, "  CONTEXT        Context path for execution (can also be specified with -c, --context)\n")
+
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  facts          Print the facts of the target as JSON\n")
+		fmt.Fprintf(os.Stderr, "  lint           Check the Containerfile for problems without running it\n")
+		fmt.Fprintf(os.Stderr, "  fmt            Format the Containerfile in canonical form\n")
+		fmt.Fprintf(os.Stderr, "  export         Convert the Containerfile to apply it without machinefile\n")
 	}
 
 	// Parse flags
@@ -120,14 +180,39 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Progress is written to stderr when stdout is used for output
+	status := io.Writer(os.Stdout)
+	if command != "" {
+		status = os.Stderr
+	}
+
 	var dockerfilePath string
 	var context string
 	predefinedArgs := make(map[string]string)
 	predefinedArgs["MACHINEFILE"] = VERSION
 	predefinedArgs["BUILDKIT_SYNTAX"] = ""  // Common ARG in Containerfiles
-	predefinedArgs["BUILD_DATE"] = `"` + time.Now().UTC().Format(DATE_FORMAT) + `"`
+	predefinedArgs["BUILD_DATE"] = time.Now().UTC().Format(DATE_FORMAT)
 
 	remainingArgs := flag.Args()
+
+	// Host aliases from the ssh config can be used as targets like user@host
+	var hostCandidates []string
+	loadSSHConfig := func() *machinefile.SSHConfig {
+		configPath := *sshConfigPath
+		if configPath == "" {
+			configPath = machinefile.DefaultSSHConfigPath()
+		}
+		config, err := machinefile.LoadSSHConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading ssh config: %v\n", err)
+			os.Exit(1)
+		}
+		return config
+	}
+	var sshConfig *machinefile.SSHConfig
+	if !*stdinMode {
+		sshConfig = loadSSHConfig()
+	}
 	if *stdinMode {
 		if len(os.Args) < 3 {
 			fmt.Fprintf(os.Stderr, "Error: insufficient arguments for shebang mode\n")
@@ -158,6 +243,63 @@ func main() {
 				*usePodmanValue = true
 			case "s", "ssh":
 				*useSSHValue = true
+			case "chroot":
+				if i+1 < len(os.Args) {
+					*chrootDir = os.Args[i+1]
+					i++
+				}
+			case "nspawn":
+				if i+1 < len(os.Args) {
+					*nspawnDir = os.Args[i+1]
+					i++
+				}
+			case "nspawn-machine":
+				if i+1 < len(os.Args) {
+					*nspawnMachine = os.Args[i+1]
+					i++
+				}
+			case "inventory":
+				if i+1 < len(os.Args) {
+					*inventoryPath = os.Args[i+1]
+					i++
+				}
+			case "limit":
+				if i+1 < len(os.Args) {
+					*limit = os.Args[i+1]
+					i++
+				}
+			case "forks":
+				if i+1 < len(os.Args) {
+					n, err := strconv.Atoi(os.Args[i+1])
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error parsing forks: %v\n", err)
+						os.Exit(1)
+					}
+					*forks = n
+					i++
+				}
+			case "serial":
+				if i+1 < len(os.Args) {
+					*serial = os.Args[i+1]
+					i++
+				}
+			case "max-fail-percentage":
+				if i+1 < len(os.Args) {
+					n, err := strconv.Atoi(os.Args[i+1])
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error parsing max-fail-percentage: %v\n", err)
+						os.Exit(1)
+					}
+					*maxFailPercentage = n
+					i++
+				}
+			case "stop-on-failure":
+				*stopOnFailure = true
+			case "jump":
+				if i+1 < len(os.Args) {
+					jumpHosts = append(jumpHosts, os.Args[i+1])
+					i++
+				}
 			case "f", "file":
 				if i+1 < len(os.Args) {
 					dockerfilePath = os.Args[i+1]
@@ -193,13 +335,58 @@ func main() {
 					predefinedArgs[key] = value
 					i++
 				}
+			case "cert":
+				if i+1 < len(os.Args) {
+					*sshCertPath = os.Args[i+1]
+					i++
+				}
+			case "forward-agent":
+				*forwardAgent = true
+			case "no-agent":
+				*noAgent = true
+			case "become":
+				*becomeEnabled = true
+			case "become-method":
+				if i+1 < len(os.Args) {
+					*becomeMethod = os.Args[i+1]
+					i++
+				}
+			case "ask-become-password":
+				*askBecomePassword = true
+			case "dry-run":
+				*dryRun = true
+			case "no-manifest":
+				*noManifest = true
+			case "apply-expose":
+				*applyExpose = true
+			case "healthcheck-timer":
+				*healthcheckTimer = true
+			case "install-service":
+				if i+1 < len(os.Args) {
+					*installService = os.Args[i+1]
+					i++
+				}
+			case "ssh-config":
+				if i+1 < len(os.Args) {
+					*sshConfigPath = os.Args[i+1]
+					i++
+				}
 			default:
 				if user, host, ok := parseUserHost(arg); ok {
 					*sshUserValue = user
 					*sshHostValue = host
+				} else if !strings.HasPrefix(arg, "-") {
+					hostCandidates = append(hostCandidates, arg)
 				}
 			}
 		}
+
+		sshConfig = loadSSHConfig()
+		for _, arg := range hostCandidates {
+			if *sshHostValue == "" && isSSHAlias(sshConfig, arg) {
+				*sshHostValue = arg
+			}
+		}
 	} else {
 		// Fix to parse user@host from positional arguments
 		for i := 0; i < len(remainingArgs); i++ {
@@ -213,6 +400,11 @@ func main() {
 				*sshHostValue = host
 				continue
 			}
+
+			if isSSHAlias(sshConfig, arg) {
+				*sshHostValue = arg
+				continue
+			}
 			
 			if dockerfilePath == "" {
 				dockerfilePath = arg
@@ -221,6 +413,12 @@ func main() {
 			}
 		}
 
+		// The facts command takes a target instead of a Containerfile
+		if command == "facts" && dockerfilePath != "" && *sshHostValue == "" {
+			*sshHostValue = dockerfilePath
+			dockerfilePath = ""
+		}
+
 		// Handle file and context from flags first
 		if *dockerFile != "" {
 			dockerfilePath = string(*dockerFile)
@@ -250,39 +448,226 @@ func main() {
 		context = getExecutionContext(dockerfilePath)
 	}
 
-	var runner machinefile.Runner
+	sshJump, err := machinefile.ParseJumpHosts(jumpHosts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing jump hosts: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Determine which runner to use based on flags and parameters
-	switch {
-	case bool(*useSSHValue) || (!bool(*useLocalValue) && !bool(*usePodmanValue) && *sshHostValue != ""):
-		sshUsername := string(*sshUserValue)
-		if sshUsername == "" {
-			currentUser, err := user.Current()
+	if err := machinefile.ValidateBecomeMethod(*becomeMethod); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	become := &machinefile.Become{
+		Enabled:  *becomeEnabled,
+		Method:   *becomeMethod,
+		Password: os.Getenv("MACHINEFILE_BECOME_PASSWORD"),
+	}
+	if *askBecomePassword {
+		become.Password, err = readPassword(fmt.Sprintf("Enter %s password: ", *becomeMethod))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading password: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Authenticate with keys held by ssh-agent, including security keys, when
+	// no key or password is given. ssh and scp use SSH_AUTH_SOCK by
+	// themselves, so --no-agent has to tell them not to.
+	var sshAgentSocket string
+	usesSSH := *inventoryPath != "" || bool(*useSSHValue) || *sshHostValue != ""
+	if *noAgent {
+		sshAgentSocket = "none"
+	} else if usesSSH && *sshKeyPath == "" && *sshPassword == "" && !*askPassword {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if keys, err := machinefile.SSHAgentKeys(socket); err != nil {
+			if socket != "" || *forwardAgent {
+				fmt.Fprintf(os.Stderr, "Warning: ssh-agent not usable: %v\n", err)
+			}
+		} else {
+			sshAgentSocket = socket
+			fmt.Fprintf(status, "Using ssh-agent with %d keys\n", len(keys))
+		}
+	}
+
+	if *healthcheckTimer && *installService == "" {
+		fmt.Fprintf(os.Stderr, "Error: --healthcheck-timer requires --install-service\n")
+		os.Exit(1)
+	}
+	options := machinefile.Options{
+		InstallService:   *installService,
+		HealthcheckTimer: *healthcheckTimer,
+		ApplyExpose:      *applyExpose,
+		NoManifest:       *noManifest,
+	}
+
+	if *inventoryPath != "" {
+		// An inventory always runs over SSH, so any other runner selection
+		// would be silently ignored
+		if bool(*useLocalValue) || bool(*usePodmanValue) || *containerName != "" || *sshHostValue != "" ||
+			*chrootDir != "" || *nspawnDir != "" || *nspawnMachine != "" {
+			fmt.Fprintf(os.Stderr, "Error: --inventory can not be combined with --local, --podman, --name, --host, --chroot, --nspawn or --nspawn-machine\n")
+			os.Exit(1)
+		}
+
+		inventory, err := machinefile.LoadInventory(*inventoryPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading inventory: %v\n", err)
+			os.Exit(1)
+		}
+		hosts, err := inventory.Limit(*limit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Prompt once for the whole inventory instead of once per host
+		password := *sshPassword
+		if *askPassword {
+			password, err = readPassword("Enter SSH password for inventory hosts: ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading password: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		defaults := machinefile.SSHRunner{
+			BaseDir:        context,
+			SshUser:        string(*sshUserValue),
+			SshPort:        *sshPort,
+			SshKeyPath:     *sshKeyPath,
+			SshPassword:    password,
+			SshJump:        sshJump,
+			SshConfigPath:  *sshConfigPath,
+			SshCertPath:    *sshCertPath,
+			SshAgentSocket: sshAgentSocket,
+			ForwardAgent:   *forwardAgent,
+			Become:         become,
+		}
+
+		var targets []machinefile.FleetTarget
+		for _, host := range hosts {
+			runner := host.SSHRunner(defaults)
+			runner.SshUser, err = resolveSSHUser(sshConfig, runner.SshHost, runner.SshUser)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error getting current user: %v\n", err)
 				os.Exit(1)
 			}
-			sshUsername = currentUser.Username
+			runner.Stdout = machinefile.NewPrefixWriter(os.Stdout, "["+host.Name+"] ")
+			runner.Stderr = machinefile.NewPrefixWriter(os.Stderr, "["+host.Name+"] ")
+
+			hostArgs := make(map[string]string)
+			for k, v := range predefinedArgs {
+				hostArgs[k] = v
+			}
+			for k, v := range host.Args() {
+				hostArgs[k] = v
+			}
+
+			var target machinefile.Runner = runner
+			if *dryRun {
+				target = &machinefile.DryRunner{Runner: runner}
+			}
+			targets = append(targets, machinefile.FleetTarget{Name: host.Name, Runner: target, Args: hostArgs})
+		}
+
+		if command == "facts" {
+			if failed := printFleetFacts(targets); failed > 0 {
+				os.Exit(1)
+			}
+			return
 		}
 
+		fmt.Fprintf(status, "Running on %d hosts from inventory %s\n", len(targets), *inventoryPath)
+		strategy := machinefile.FleetStrategy{
+			Forks:             *forks,
+			Serial:            *serial,
+			MaxFailPercentage: *maxFailPercentage,
+			StopOnFailure:     *stopOnFailure,
+		}
+		results, err := machinefile.RunFleet(dockerfilePath, targets, strategy, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if failed := machinefile.PrintFleetSummary(os.Stdout, results); failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var runner machinefile.Runner
+
+	// Determine which runner to use based on flags and parameters
+	switch {
+	case *chrootDir != "":
+		info, err := os.Stat(*chrootDir)
+		if err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "Error: chroot runner requires an existing rootfs directory: %s\n", *chrootDir)
+			os.Exit(1)
+		}
+
+		runner = &machinefile.ChrootRunner{
+			BaseDir: context,
+			RootDir: *chrootDir,
+		}
+
+		fmt.Fprintf(status, "Running in chroot %s\n", *chrootDir)
+
+	case *nspawnDir != "" || *nspawnMachine != "":
+		if *nspawnDir != "" && *nspawnMachine != "" {
+			fmt.Fprintf(os.Stderr, "Error: --nspawn and --nspawn-machine are mutually exclusive\n")
+			os.Exit(1)
+		}
+
+		runner = &machinefile.NspawnRunner{
+			BaseDir:   context,
+			Directory: *nspawnDir,
+			Machine:   *nspawnMachine,
+		}
+
+		if *nspawnDir != "" {
+			fmt.Fprintf(status, "Running in systemd-nspawn container for %s\n", *nspawnDir)
+		} else {
+			fmt.Fprintf(status, "Running in systemd-nspawn machine %s\n", *nspawnMachine)
+		}
+
+	case bool(*useSSHValue) || (!bool(*useLocalValue) && !bool(*usePodmanValue) && *sshHostValue != ""):
 		if *sshHostValue == "" {
 			fmt.Fprintf(os.Stderr, "Error: SSH runner requires -H/--host parameter\n")
 			os.Exit(1)
 		}
 
+		sshUsername, err := resolveSSHUser(sshConfig, *sshHostValue, string(*sshUserValue))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting current user: %v\n", err)
+			os.Exit(1)
+		}
+
 		sshPort := string(*sshPort);
 
 		runner = &machinefile.SSHRunner{
-			BaseDir:     context,
-			SshHost:     string(*sshHostValue),
-			SshUser:     sshUsername,
-			SshPort:     sshPort,
-			SshKeyPath:  *sshKeyPath,
-			SshPassword: *sshPassword,
-			AskPassword: *askPassword,
+			BaseDir:        context,
+			SshHost:        string(*sshHostValue),
+			SshUser:        sshUsername,
+			SshPort:        sshPort,
+			SshKeyPath:     *sshKeyPath,
+			SshPassword:    *sshPassword,
+			AskPassword:    *askPassword,
+			SshJump:        sshJump,
+			SshConfigPath:  *sshConfigPath,
+			SshCertPath:    *sshCertPath,
+			SshAgentSocket: sshAgentSocket,
+			ForwardAgent:   *forwardAgent,
+			Become:         become,
 		}
 
-		fmt.Printf("Running on remote host %s as user %s\n", string(*sshHostValue), sshUsername)
+		hostConfig := sshConfig.Resolve(*sshHostValue)
+		if hostConfig.HostName != *sshHostValue {
+			fmt.Fprintf(status, "Running on remote host %s (%s) as user %s\n", string(*sshHostValue), hostConfig.HostName, sshUsername)
+		} else {
+			fmt.Fprintf(status, "Running on remote host %s as user %s\n", string(*sshHostValue), sshUsername)
+		}
 
 	case bool(*usePodmanValue) || (!bool(*useLocalValue) && !bool(*useSSHValue) && *containerName != ""):
 		if *containerName == "" {
@@ -297,26 +682,45 @@ func main() {
 			PodmanBinary:  *podmanBinary,
 		}
 
-		fmt.Printf("Running in Podman container %s\n", string(*containerName))
+		fmt.Fprintf(status, "Running in Podman container %s\n", string(*containerName))
 		if *connection != "" {
-			fmt.Printf("Using Podman connection: %s\n", *connection)
+			fmt.Fprintf(status, "Using Podman connection: %s\n", *connection)
 		}
 
 	case bool(*useLocalValue):
 		runner = &machinefile.LocalRunner{
 			BaseDir: context,
+			Become:  become,
 		}
-		fmt.Printf("Running locally in context: %s\n", context)
+		fmt.Fprintf(status, "Running locally in context: %s\n", context)
 
 	default:
 		// Default to local runner if no specific runner is selected
 		runner = &machinefile.LocalRunner{
 			BaseDir: context,
+			Become:  become,
+		}
+		fmt.Fprintf(status, "Running locally in context: %s (default)\n", context)
+	}
+
+	if command == "facts" {
+		if err := printFacts(os.Stdout, runner); err != nil {
+			fmt.Fprintf(os.Stderr, "Error gathering facts: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *dryRun {
+		fmt.Println("Dry run, target facts:")
+		if err := printFacts(os.Stdout, runner); err != nil {
+			fmt.Fprintf(os.Stderr, "Error gathering facts: %v\n", err)
+			os.Exit(1)
 		}
-		fmt.Printf("Running locally in context: %s (default)\n", context)
+		runner = &machinefile.DryRunner{Runner: runner}
 	}
 
-	err := machinefile.ParseAndRunDockerfile(dockerfilePath, runner, predefinedArgs)
+	err = machinefile.ParseAndRunDockerfile(dockerfilePath, runner, predefinedArgs, options)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error running Dockerfile: %v\n", err)
 		os.Exit(1)
@@ -3,7 +3,7 @@ module github.com/gbraad-redhat/machinefile
 go 1.23.4
 
 require (
-	golang.org/x/crypto v0.35.0 // indirect
-	golang.org/x/sys v0.30.0 // indirect
-	golang.org/x/term v0.29.0 // indirect
+	golang.org/x/crypto v0.35.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
 )
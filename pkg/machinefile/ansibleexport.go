@@ -0,0 +1,911 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ansibleFactsVar holds the facts gathered by the playbook, by name
+const ansibleFactsVar = "machinefile_facts"
+
+// ansiblePlatformArgs are the Jinja expressions of the built-in platform ARGs,
+// set from the facts of the host the playbook runs on
+var ansiblePlatformArgs = []struct{ name, value string }{
+	{"TARGETOS", "machinefile_facts['os']"},
+	{"TARGETARCH", "machinefile_facts['arch']"},
+	{"TARGETVARIANT", "machinefile_facts['variant']"},
+	{"TARGETPLATFORM", "(machinefile_facts['os'] ~ '/' ~ machinefile_facts['arch'] ~ ('/' ~ machinefile_facts['variant'] if machinefile_facts['variant'] else ''))"},
+	{"BUILDPLATFORM", "(machinefile_facts['os'] ~ '/' ~ machinefile_facts['arch'])"},
+	{"TARGET_HOSTNAME", "machinefile_facts['hostname']"},
+	{"TARGET_DISTRO_ID", "machinefile_facts['distro']"},
+	{"TARGET_DISTRO_VERSION", "machinefile_facts['distro_version']"},
+}
+
+// ansibleArchiveSuffixes are the local archives that ADD extracts, like
+// Docker does
+var ansibleArchiveSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"}
+
+// jinjaWord renders words of the Dockerfile as Jinja templates, or as a Jinja
+// expression when expression is true. vars holds the expression of each
+// variable in scope: the name of the play var for an ARG, and the value for
+// an ENV.
+type jinjaWord struct {
+	vars       map[string]string
+	expression bool
+}
+
+func (jw jinjaWord) literal(text string, nested bool) string {
+	if nested || jw.expression {
+		return "~" + jinjaString(text)
+	}
+	if strings.Contains(text, "{") {
+		return "{{ " + jinjaString(text) + " }}"
+	}
+	return text
+}
+
+func (jw jinjaWord) variable(name, operator, word string, nested bool) string {
+	value, set := jw.vars[name]
+	alternative := jinjaConcat(word)
+
+	// Values known at export time are expanded right away
+	if text, ok := jinjaLiteral(value); set && ok {
+		switch {
+		case operator == ":-" && text == "":
+			value = alternative
+		case operator == ":?" && text == "":
+			set = false
+		case operator == ":+" && text == "":
+			value = "''"
+		case operator == ":+" || operator == "+":
+			value = alternative
+		}
+		if set {
+			operator = ""
+		}
+	}
+
+	var expr string
+	switch operator {
+	case "":
+		expr = "''"
+		if set {
+			expr = value
+		}
+	case ":-":
+		expr = alternative
+		if set {
+			expr = fmt.Sprintf("(%s or %s)", value, alternative)
+		}
+	case "-":
+		expr = alternative
+		if set {
+			expr = value
+		}
+	case ":+":
+		expr = "''"
+		if set {
+			expr = fmt.Sprintf("(%s if %s else '')", alternative, value)
+		}
+	case "+":
+		expr = "''"
+		if set {
+			expr = alternative
+		}
+	case ":?", "?":
+		expr = fmt.Sprintf("undef(hint=%s)", alternative)
+		if set && operator == "?" {
+			expr = value
+		} else if set {
+			expr = fmt.Sprintf("(%s or %s)", value, expr)
+		}
+	}
+	if nested || jw.expression {
+		return "~" + expr
+	}
+	return "{{ " + expr + " }}"
+}
+
+// jinjaString quotes text as a Jinja string literal
+func jinjaString(text string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(text) + "'"
+}
+
+// jinjaLiteral returns the text of an expression that is a single string
+// literal
+func jinjaLiteral(expr string) (string, bool) {
+	if len(expr) < 2 || expr[0] != '\'' || expr[len(expr)-1] != '\'' || len(jinjaTerms(expr)) != 1 {
+		return "", false
+	}
+	return strings.NewReplacer(`\\`, `\`, `\'`, `'`).Replace(expr[1 : len(expr)-1]), true
+}
+
+// jinjaTerms splits an expression into the terms joined by ~ outside of
+// parentheses and string literals
+func jinjaTerms(expr string) []string {
+	var terms []string
+	start, depth := 0, 0
+	quoted, escaped := false, false
+	for i, ch := range expr {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && ch == '\\':
+			escaped = true
+		case ch == '\'':
+			quoted = !quoted
+		case quoted:
+		case ch == '(' || ch == '[':
+			depth++
+		case ch == ')' || ch == ']':
+			depth--
+		case ch == '~' && depth == 0:
+			terms = append(terms, expr[start:i])
+			start = i + 1
+		}
+	}
+	return append(terms, expr[start:])
+}
+
+// jinjaConcat turns the ~ separated terms of a rendered expression into a
+// single expression, joining string literals
+func jinjaConcat(expr string) string {
+	var terms []string
+	var text strings.Builder
+	literal := false
+	for _, term := range jinjaTerms(strings.TrimPrefix(expr, "~")) {
+		if value, ok := jinjaLiteral(term); ok {
+			text.WriteString(value)
+			literal = true
+			continue
+		}
+		if term == "" {
+			continue
+		}
+		if literal && text.Len() > 0 {
+			terms = append(terms, jinjaString(text.String()))
+		}
+		text.Reset()
+		literal = false
+		terms = append(terms, term)
+	}
+	if text.Len() > 0 || len(terms) == 0 {
+		terms = append(terms, jinjaString(text.String()))
+	}
+	if len(terms) > 1 {
+		return "(" + strings.Join(terms, " ~ ") + ")"
+	}
+	return terms[0]
+}
+
+// jinjaTemplate returns an expression as a template, which is plain text for
+// a string literal
+func jinjaTemplate(expr string) string {
+	if text, ok := jinjaLiteral(expr); ok && !strings.Contains(text, "{") {
+		return text
+	}
+	return "{{ " + expr + " }}"
+}
+
+// jinjaRaw keeps Ansible from templating text that contains Jinja syntax
+func jinjaRaw(text string) string {
+	if strings.Contains(text, "{{") || strings.Contains(text, "{%") || strings.Contains(text, "{#") {
+		return "{% raw %}" + text + "{% endraw %}"
+	}
+	return text
+}
+
+// yamlString quotes text as a YAML double quoted string
+func yamlString(text string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(text)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// yamlText writes text of several lines as a literal block scalar with the
+// given indentation, and other text as a double quoted string
+func yamlText(text, indent string) string {
+	if !strings.Contains(text, "\n") || strings.HasPrefix(text, " ") || strings.ContainsAny(text, "\r\x00") {
+		return yamlString(text)
+	}
+	var block strings.Builder
+	if strings.HasSuffix(text, "\n") {
+		block.WriteString("|")
+	} else {
+		block.WriteString("|-")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		block.WriteString("\n")
+		if line != "" {
+			block.WriteString(indent + line)
+		}
+	}
+	return block.String()
+}
+
+// ansibleStage is a play of the playbook, built from a stage
+type ansibleStage struct {
+	name     string
+	varNames []string          // Play vars in order of declaration
+	vars     map[string]string // Play vars as templates
+	argLines map[string]int    // Lines ARGs are declared on
+	scope    map[string]string // Expressions of the ARGs and ENVs in scope
+	tasks    strings.Builder
+
+	// Expressions of USER, WORKDIR, the index of the health check and
+	// whether ENTRYPOINT or CMD define a service
+	user, workdir, health, service string
+}
+
+func newAnsibleStage(name string) *ansibleStage {
+	return &ansibleStage{
+		name:     name,
+		vars:     make(map[string]string),
+		argLines: make(map[string]int),
+		scope:    make(map[string]string),
+		health:   "''",
+		service:  "''",
+	}
+}
+
+// ansibleExporter converts a Dockerfile into an Ansible playbook with a play
+// for each stage. ARGs become play vars that can be overridden with
+// --extra-vars, and the other words are Jinja templates expanded when the
+// playbook runs.
+type ansibleExporter struct {
+	df      *Dockerfile
+	options ExportOptions
+
+	plays  []*ansibleStage
+	stage  *ansibleStage
+	stages map[string]*ansibleStage // Named stages
+
+	globals      map[string]string // Expressions of the global ARGs
+	staticVars   map[string]string // Values of the stage at export time, for COPY sources
+	staticGlobal map[string]string
+	staticStage  map[*ansibleStage]map[string]string // ENVs of stages at export time
+
+	healthchecks []*healthcheck
+	needFacts    bool
+}
+
+// exportAnsible writes the Dockerfile as an Ansible playbook
+func exportAnsible(df *Dockerfile, options ExportOptions) (string, error) {
+	e := &ansibleExporter{
+		df:           df,
+		options:      options,
+		stages:       make(map[string]*ansibleStage),
+		globals:      make(map[string]string),
+		staticGlobal: make(map[string]string),
+		staticStage:  make(map[*ansibleStage]map[string]string),
+	}
+	for _, arg := range ansiblePlatformArgs {
+		e.globals[arg.name] = arg.value
+	}
+	for k, v := range options.Args {
+		if builtinArgs[k] {
+			e.globals[k] = jinjaString(v)
+			e.staticGlobal[k] = v
+		}
+	}
+	if !hasFrom(df.Instructions) {
+		e.startStage(newAnsibleStage(e.source()))
+	}
+
+	for _, inst := range df.Instructions {
+		if err := e.instruction(inst); err != nil {
+			return "", err
+		}
+	}
+	e.finish()
+	return e.playbook(), nil
+}
+
+func (e *ansibleExporter) source() string {
+	if e.options.Source == "" {
+		return "a Containerfile"
+	}
+	return e.options.Source
+}
+
+// playbook assembles the header, the plays and their tasks
+func (e *ansibleExporter) playbook() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "# Generated by machinefile %s from %s\n", e.options.Version, e.source())
+	fmt.Fprintf(&out, "#\n")
+	fmt.Fprintf(&out, "# Applies the steps like machinefile does: RUN with bash, USER through become\n")
+	fmt.Fprintf(&out, "# and ENV as the environment of each step. ARGs are play vars that can be\n")
+	fmt.Fprintf(&out, "# overridden with --extra-vars NAME=value. No manifest is written.\n")
+	fmt.Fprintf(&out, "---\n")
+	if len(e.plays) == 0 {
+		out.WriteString("[]\n")
+		return out.String()
+	}
+
+	for i, play := range e.plays {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "- name: %s\n", yamlString(play.name))
+		out.WriteString("  hosts: all\n")
+		out.WriteString("  gather_facts: false\n")
+		if len(play.varNames) == 0 {
+			out.WriteString("  vars: {}\n")
+		} else {
+			out.WriteString("  vars:\n")
+			for _, name := range play.varNames {
+				fmt.Fprintf(&out, "    %s: %s\n", name, yamlString(play.vars[name]))
+			}
+		}
+		tasks := play.tasks.String()
+		if i == 0 && e.needFacts {
+			if tasks != "" {
+				tasks = "\n" + tasks
+			}
+			tasks = e.factsTasks() + tasks
+		}
+		if tasks == "" {
+			out.WriteString("  tasks: []\n")
+			continue
+		}
+		out.WriteString("  tasks:\n")
+		out.WriteString(tasks)
+	}
+	return out.String()
+}
+
+// factsTasks gathers the facts used by conditions and platform ARGs with the
+// script of the shell export, setting them as a dictionary
+func (e *ansibleExporter) factsTasks() string {
+	names := make(map[string]bool)
+	for name := range knownFacts {
+		names[name] = true
+	}
+	var script strings.Builder
+	script.WriteString(shellHelper("machinefile_gather_facts") + "\n")
+	fmt.Fprintf(&script, "machinefile_gather_facts %s\n", shellQuote(factsScript))
+	fmt.Fprintf(&script, "for name in %s; do\n", strings.Join(sortedKeys(names), " "))
+	script.WriteString("\teval \"printf '%s=%s\\n' \\\"\\$name\\\" \\\"\\$machinefile_fact_$name\\\"\"\n")
+	script.WriteString("done")
+
+	var tasks strings.Builder
+	tasks.WriteString("    - name: Gather machinefile facts\n")
+	fmt.Fprintf(&tasks, "      ansible.builtin.shell: %s\n", yamlText(jinjaRaw(script.String()), "        "))
+	tasks.WriteString("      register: machinefile_facts_output\n")
+	tasks.WriteString("      changed_when: false\n")
+	tasks.WriteString("\n")
+	tasks.WriteString("    - name: Set machinefile facts\n")
+	tasks.WriteString("      ansible.builtin.set_fact:\n")
+	fmt.Fprintf(&tasks, "        %s: %s\n", ansibleFactsVar, yamlString(
+		"{{ dict(machinefile_facts_output.stdout_lines | map('regex_replace', '=.*$', '')"+
+			" | zip(machinefile_facts_output.stdout_lines | map('regex_replace', '^[^=]*=', ''))) }}"))
+	return tasks.String()
+}
+
+// expression renders a word as a Jinja expression of the variables in scope
+func (e *ansibleExporter) expression(inst *Instruction, word string) (string, error) {
+	rendered, err := renderWord(word, e.df.EscapeToken, jinjaWord{vars: e.scope(), expression: true})
+	if err != nil {
+		return "", fmt.Errorf("invalid %s command on line %d: %w", inst.Command, inst.Line, err)
+	}
+	return jinjaConcat(rendered), nil
+}
+
+func (e *ansibleExporter) scope() map[string]string {
+	if e.stage == nil {
+		return e.globals
+	}
+	return e.stage.scope
+}
+
+// conditional returns the expression of a value set by an instruction, which
+// keeps the previous value when the condition is false
+func conditional(value, when, previous string) string {
+	if when == "" {
+		return value
+	}
+	if previous == "" {
+		previous = "''"
+	}
+	return fmt.Sprintf("(%s if %s else %s)", value, when, previous)
+}
+
+func (e *ansibleExporter) instruction(inst *Instruction) error {
+	var when string
+	if inst.When != "" {
+		if inst.Command == "FROM" {
+			return fmt.Errorf("FROM on line %d can not be conditional", inst.Line)
+		}
+		var err error
+		if when, err = e.condition(inst.When); err != nil {
+			return fmt.Errorf("error in condition on line %d: %w", inst.Line, err)
+		}
+	}
+
+	if inst.Command == "FROM" {
+		return e.from(inst)
+	}
+	if e.stage == nil {
+		if inst.Command != "ARG" {
+			return fmt.Errorf("%s on line %d must follow FROM", inst.Command, inst.Line)
+		}
+		return e.arg(inst, when)
+	}
+
+	st := e.stage
+	switch inst.Command {
+	case "RUN":
+		extra := []string{"args:", "  executable: /bin/bash"}
+		if st.workdir != "" {
+			extra = append(extra, "  chdir: "+yamlString(jinjaTemplate(st.workdir)))
+		}
+		e.task(inst.String(), when, true, "ansible.builtin.shell", yamlString(jinjaRaw(inst.Args)), nil, extra)
+	case "COPY", "ADD":
+		return e.copy(inst, when)
+	case "USER":
+		user, err := e.expression(inst, inst.Args)
+		if err != nil {
+			return err
+		}
+		st.user = conditional(user, when, st.user)
+	case "WORKDIR":
+		workdir, err := e.expression(inst, inst.Args)
+		if err != nil {
+			return err
+		}
+		base := st.workdir
+		if base == "" {
+			base = jinjaString("/")
+		}
+		workdir = joinWorkdir(base, workdir)
+		e.task(inst.String(), when, false, "ansible.builtin.file", "", []string{"path: " + yamlString(jinjaTemplate(workdir)), "state: directory"}, nil)
+		st.workdir = conditional(workdir, when, st.workdir)
+	case "ENV":
+		return e.env(inst, when)
+	case "ARG":
+		return e.arg(inst, when)
+	case "VOLUME":
+		words := splitWords(inst.Args, e.df.EscapeToken)
+		if list, ok := jsonList(inst.Args); ok {
+			words = list
+		}
+		if len(words) == 0 {
+			return fmt.Errorf("VOLUME on line %d requires at least one path", inst.Line)
+		}
+		extra := []string{"loop:"}
+		for _, volume := range words {
+			path, err := e.expression(inst, volume)
+			if err != nil {
+				return err
+			}
+			extra = append(extra, "  - "+yamlString(jinjaTemplate(path)))
+		}
+		e.task(inst.String(), when, false, "ansible.builtin.file", "", []string{`path: "{{ item }}"`, "state: directory"}, extra)
+	case "HEALTHCHECK":
+		check, err := parseHealthcheck(inst.Args)
+		if err != nil {
+			return fmt.Errorf("invalid HEALTHCHECK command on line %d: %w", inst.Line, err)
+		}
+		index := "''"
+		if check != nil {
+			e.healthchecks = append(e.healthchecks, check)
+			index = jinjaString(strconv.Itoa(len(e.healthchecks)))
+		}
+		st.health = conditional(index, when, st.health)
+	case "ENTRYPOINT", "CMD":
+		// Services are not installed by the playbook, so there is nothing
+		// for a health check to verify
+		st.service = conditional(jinjaString("1"), when, st.service)
+		e.comment(inst, "is recorded for services, not applied by this playbook")
+	case "EXPOSE", "LABEL", "STOPSIGNAL":
+		e.comment(inst, "is recorded for services and the manifest, not applied by this playbook")
+	default:
+		e.comment(inst, "is not supported")
+	}
+	return nil
+}
+
+// joinWorkdir returns the expression of a path, which is relative to the
+// WORKDIR expression workdir unless it is absolute
+func joinWorkdir(workdir, path string) string {
+	text, ok := jinjaLiteral(path)
+	if !ok {
+		return fmt.Sprintf("(%s if %s.startswith('/') else %s ~ '/' ~ %s)", path, path, workdir, path)
+	}
+	if filepath.IsAbs(text) {
+		return path
+	}
+	base, ok := jinjaLiteral(workdir)
+	if !ok {
+		return fmt.Sprintf("(%s ~ '/' ~ %s)", workdir, path)
+	}
+	joined := filepath.Join(base, text)
+	if strings.HasSuffix(text, "/") && joined != "/" {
+		joined += "/"
+	}
+	return jinjaString(joined)
+}
+
+// comment records an instruction without a task
+func (e *ansibleExporter) comment(inst *Instruction, note string) {
+	if e.stage.tasks.Len() > 0 {
+		e.stage.tasks.WriteString("\n")
+	}
+	fmt.Fprintf(&e.stage.tasks, "    # %s %s\n", strings.ReplaceAll(inst.String(), "\n", " "), note)
+}
+
+// task writes a task for an instruction, calling module with value or with
+// params, followed by the extra keys and the condition. Steps run as USER
+// with the ARGs and ENVs as environment.
+func (e *ansibleExporter) task(name, when string, step bool, module, value string, params, extra []string) {
+	tasks := &e.stage.tasks
+	if tasks.Len() > 0 {
+		tasks.WriteString("\n")
+	}
+	fmt.Fprintf(tasks, "    - name: %s\n", yamlString(jinjaRaw(name)))
+	if len(params) == 0 {
+		fmt.Fprintf(tasks, "      %s: %s\n", module, value)
+	} else {
+		fmt.Fprintf(tasks, "      %s:\n", module)
+		for _, param := range params {
+			tasks.WriteString("        " + param + "\n")
+		}
+	}
+	for _, line := range extra {
+		tasks.WriteString("      " + line + "\n")
+	}
+	if step {
+		e.stepKeys(tasks)
+	}
+	if when != "" {
+		fmt.Fprintf(tasks, "      when: %s\n", yamlString(when))
+	}
+}
+
+// stepKeys writes the environment and become keys of a step
+func (e *ansibleExporter) stepKeys(tasks *strings.Builder) {
+	st := e.stage
+	names := make(map[string]bool)
+	for name := range st.scope {
+		names[name] = true
+	}
+	if len(names) > 0 {
+		tasks.WriteString("      environment:\n")
+		for _, name := range sortedKeys(names) {
+			fmt.Fprintf(tasks, "        %s: %s\n", name, yamlString(jinjaTemplate(st.scope[name])))
+		}
+	}
+	if st.user == "" {
+		return
+	}
+
+	// Like the runners, a group after the user is passed to sudo with -g
+	// and numeric ids get a # prefix
+	if user, ok := jinjaLiteral(st.user); ok {
+		if user == "" {
+			return
+		}
+		name, group, hasGroup := strings.Cut(user, ":")
+		tasks.WriteString("      become: true\n")
+		fmt.Fprintf(tasks, "      become_user: %s\n", yamlString(jinjaRaw(sudoID(name))))
+		if hasGroup {
+			fmt.Fprintf(tasks, "      become_flags: %s\n", yamlString(jinjaRaw("-H -S -n -g "+sudoID(group))))
+		}
+		return
+	}
+	fmt.Fprintf(tasks, "      become: %s\n", yamlString(fmt.Sprintf("{{ %s != '' }}", st.user)))
+	fmt.Fprintf(tasks, "      become_user: %s\n", yamlString(fmt.Sprintf("{{ %s.split(':')[0] }}", st.user)))
+	fmt.Fprintf(tasks, "      become_flags: %s\n", yamlString(fmt.Sprintf("{{ '-H -S -n' ~ (' -g ' ~ %s.split(':')[1] if ':' in %s else '') }}", st.user, st.user)))
+}
+
+// from starts a play for a stage, which inherits the ENVs, USER, WORKDIR and
+// health check of the stage it is built from, with the play vars they use
+func (e *ansibleExporter) from(inst *Instruction) error {
+	words, err := processWords(inst, e.staticGlobal, e.df.EscapeToken)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 && (len(words) != 3 || !strings.EqualFold(words[1], "AS")) {
+		return fmt.Errorf("invalid FROM command: %s", inst)
+	}
+
+	st := newAnsibleStage(e.source() + ": FROM " + strings.Join(words, " "))
+	if parent, ok := e.stages[strings.ToLower(words[0])]; ok {
+		for _, name := range parent.varNames {
+			st.varNames = append(st.varNames, name)
+			st.vars[name] = parent.vars[name]
+		}
+		for name, value := range parent.scope {
+			if _, isArg := parent.argLines[name]; !isArg || value != name {
+				st.scope[name] = value
+			}
+		}
+		st.user, st.workdir, st.health, st.service = parent.user, parent.workdir, parent.health, parent.service
+	}
+	e.startStage(st)
+	if parent, ok := e.stages[strings.ToLower(words[0])]; ok {
+		for k, v := range e.staticStage[parent] {
+			e.staticVars[k] = v
+			e.staticStage[st][k] = v
+		}
+	}
+	if len(words) == 3 {
+		e.stages[strings.ToLower(words[2])] = st
+	}
+	return nil
+}
+
+func (e *ansibleExporter) startStage(st *ansibleStage) {
+	e.plays = append(e.plays, st)
+	e.stage = st
+	e.staticVars = make(map[string]string)
+	e.staticStage[st] = make(map[string]string)
+}
+
+// arg declares ARGs. In a stage they become play vars with the export time
+// value, the default, the global ARG or the environment of the controller,
+// in that order. An ENV of the same name keeps precedence.
+func (e *ansibleExporter) arg(inst *Instruction, when string) error {
+	assignments, err := parseAssignments("ARG", inst.Args, nil, e.df.EscapeToken, false)
+	if err != nil {
+		return fmt.Errorf("invalid ARG command on line %d: %w", inst.Line, err)
+	}
+	words := splitWords(inst.Args, e.df.EscapeToken)
+	values := make([]string, len(assignments))
+	for i, arg := range assignments {
+		if predefined, ok := e.options.Args[arg.Key]; ok {
+			values[i] = jinjaString(predefined)
+		} else if arg.HasValue {
+			_, raw, _ := strings.Cut(words[i], "=")
+			if values[i], err = e.expression(inst, raw); err != nil {
+				return err
+			}
+		} else if global, ok := e.globals[arg.Key]; ok {
+			// Declaring a global ARG again keeps its value, like the
+			// platform ARGs detected on the target
+			values[i] = global
+			if e.stage != nil && strings.Contains(global, ansibleFactsVar) {
+				e.needFacts = true
+			}
+		} else {
+			values[i] = fmt.Sprintf("lookup('env', %s)", jinjaString(arg.Key))
+		}
+	}
+
+	redeclared := make(map[string]bool)
+	for i, arg := range assignments {
+		if e.stage == nil {
+			e.globals[arg.Key] = conditional(values[i], when, e.globals[arg.Key])
+			continue
+		}
+		st := e.stage
+		if line, ok := st.argLines[arg.Key]; ok {
+			e.options.warn("ARG %s on line %d is declared again, the playbook uses the value from line %d", arg.Key, inst.Line, line)
+			redeclared[arg.Key] = true
+		} else {
+			st.argLines[arg.Key] = inst.Line
+			if _, inherited := st.vars[arg.Key]; !inherited {
+				st.varNames = append(st.varNames, arg.Key)
+			}
+			st.vars[arg.Key] = jinjaTemplate(values[i])
+		}
+		if current, ok := st.scope[arg.Key]; !ok || current == arg.Key {
+			st.scope[arg.Key] = conditional(arg.Key, when, current)
+		}
+	}
+
+	// Track the values at export time for COPY sources
+	vars := e.staticGlobal
+	if e.stage != nil {
+		vars = e.staticVars
+	}
+	if staticArgs, err := parseAssignments("ARG", inst.Args, vars, e.df.EscapeToken, false); err == nil {
+		for _, arg := range staticArgs {
+			if redeclared[arg.Key] {
+				continue
+			}
+			if value, ok := e.options.Args[arg.Key]; ok {
+				vars[arg.Key] = value
+			} else if arg.HasValue {
+				vars[arg.Key] = arg.Value
+			} else if _, ok := vars[arg.Key]; !ok {
+				vars[arg.Key] = e.staticGlobal[arg.Key]
+			}
+		}
+	}
+	return nil
+}
+
+// env sets ENVs, expanding all values before setting any of them
+func (e *ansibleExporter) env(inst *Instruction, when string) error {
+	assignments, err := parseAssignments("ENV", inst.Args, e.staticVars, e.df.EscapeToken, true)
+	if err != nil {
+		return fmt.Errorf("invalid ENV command on line %d: %w", inst.Line, err)
+	}
+	words := splitWords(inst.Args, e.df.EscapeToken)
+	values := make([]string, len(assignments))
+	for i, env := range assignments {
+		raw := strings.TrimPrefix(strings.TrimLeft(inst.Args, " \t"), env.Key)
+		if len(words) > 0 && strings.Contains(words[0], "=") {
+			_, raw, _ = strings.Cut(words[i], "=")
+		}
+		if values[i], err = e.expression(inst, strings.TrimSpace(raw)); err != nil {
+			return err
+		}
+		e.staticVars[env.Key] = env.Value
+		e.staticStage[e.stage][env.Key] = env.Value
+	}
+	for i, env := range assignments {
+		e.stage.scope[env.Key] = conditional(values[i], when, e.stage.scope[env.Key])
+	}
+	return nil
+}
+
+// copy writes a task for each match of a source in the context. ADD extracts
+// local tar archives, like Docker does.
+func (e *ansibleExporter) copy(inst *Instruction, when string) error {
+	words := splitWords(inst.Args, e.df.EscapeToken)
+	if len(words) != 2 {
+		return fmt.Errorf("invalid %s command: %s", inst.Command, inst)
+	}
+	pattern, err := processWord(words[0], e.staticVars, e.df.EscapeToken)
+	if err != nil {
+		return fmt.Errorf("invalid %s command on line %d: %w", inst.Command, inst.Line, err)
+	}
+	dest, err := e.expression(inst, words[1])
+	if err != nil {
+		return err
+	}
+	if e.stage.workdir != "" {
+		dest = joinWorkdir(e.stage.workdir, dest)
+	}
+	sources, err := readContextSources(e.options.ContextDir, pattern)
+	if err != nil {
+		return fmt.Errorf("error reading %s source on line %d: %w", inst.Command, inst.Line, err)
+	}
+
+	for _, source := range sources {
+		src, err := filepath.Abs(source.Path)
+		if err != nil {
+			return err
+		}
+		name := inst.String()
+		if len(sources) > 1 {
+			name += " (" + source.Name + ")"
+		}
+		// A trailing / copies the contents of a directory, like cp -a does
+		// to a new destination
+		if source.IsDir {
+			src += "/"
+		}
+		params := []string{"src: " + yamlString(jinjaRaw(src)), "dest: " + yamlString(jinjaTemplate(dest))}
+		if inst.Command == "ADD" && !source.IsDir && isArchive(source.Name) {
+			e.task(name+" (directory)", when, false, "ansible.builtin.file", "", []string{"path: " + yamlString(jinjaTemplate(dest)), "state: directory"}, nil)
+			e.task(name, when, false, "ansible.builtin.unarchive", "", params, nil)
+			continue
+		}
+		e.task(name, when, false, "ansible.builtin.copy", "", append(params, "mode: preserve"), nil)
+	}
+	return nil
+}
+
+// isArchive reports whether ADD extracts a file
+func isArchive(name string) bool {
+	for _, suffix := range ansibleArchiveSuffixes {
+		if strings.HasSuffix(strings.ToLower(name), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// condition compiles a condition into a Jinja expression for when
+func (e *ansibleExporter) condition(condition string) (string, error) {
+	node, err := parseCondition(condition)
+	if err != nil {
+		return "", err
+	}
+	return e.conditionNode(node), nil
+}
+
+func (e *ansibleExporter) conditionNode(n *conditionNode) string {
+	switch n.Operator {
+	case "":
+		return fmt.Sprintf("(%s | string | lower) not in ['', '0', 'false']", e.conditionValue(n))
+	case "!":
+		return fmt.Sprintf("not (%s)", e.conditionNode(n.Left))
+	case "||", "&&":
+		operator := "and"
+		if n.Operator == "||" {
+			operator = "or"
+		}
+		return fmt.Sprintf("(%s) %s (%s)", e.conditionNode(n.Left), operator, e.conditionNode(n.Right))
+	}
+
+	left, right := e.conditionValue(n.Left)+" | string", e.conditionValue(n.Right)+" | string"
+	switch n.Operator {
+	case "==", "!=":
+		return fmt.Sprintf("(%s) %s (%s)", left, n.Operator, right)
+	case "=~":
+		return fmt.Sprintf("(%s) is search(%s)", left, right)
+	case "!~":
+		return fmt.Sprintf("(%s) is not search(%s)", left, right)
+	}
+	return fmt.Sprintf("(%s) is version(%s, %s)", left, right, jinjaString(n.Operator))
+}
+
+// conditionValue renders the value of a node as a Jinja expression
+func (e *ansibleExporter) conditionValue(n *conditionNode) string {
+	switch {
+	case n.Operator != "":
+		return fmt.Sprintf("((%s) | string | lower)", e.conditionNode(n))
+	case n.Kind == conditionVariable:
+		if value, ok := e.scope()[n.Value]; ok {
+			return value
+		}
+		return "''"
+	case n.Kind == conditionFact:
+		e.needFacts = true
+		return fmt.Sprintf("%s[%s]", ansibleFactsVar, jinjaString(n.Value))
+	}
+	return jinjaString(n.Value)
+}
+
+// finish verifies the health check of the final stage, retrying every
+// interval until it passes, with extra retries for the start period. Checks
+// of an ENTRYPOINT or CMD are skipped.
+func (e *ansibleExporter) finish() {
+	st := e.stage
+	if st == nil || len(e.healthchecks) == 0 || st.health == "''" {
+		return
+	}
+	if service, ok := jinjaLiteral(st.service); ok && service != "" {
+		if st.tasks.Len() > 0 {
+			st.tasks.WriteString("\n")
+		}
+		st.tasks.WriteString("    # HEALTHCHECK is skipped, ENTRYPOINT and CMD are not run by this playbook\n")
+		return
+	}
+	for i, check := range e.healthchecks {
+		index := jinjaString(strconv.Itoa(i + 1))
+		var conditions []string
+		if st.health != index {
+			if _, ok := jinjaLiteral(st.health); ok {
+				continue
+			}
+			conditions = append(conditions, fmt.Sprintf("%s == %s", st.health, index))
+		}
+		if _, ok := jinjaLiteral(st.service); !ok {
+			conditions = append(conditions, fmt.Sprintf("%s == ''", st.service))
+		}
+		when := strings.Join(conditions, " and ")
+		interval := shellSeconds(check.Interval)
+		retries := check.Retries + int(math.Ceil(check.StartPeriod.Seconds()/float64(interval)))
+		extra := []string{"args:", "  executable: /bin/bash"}
+		if st.workdir != "" {
+			extra = append(extra, "  chdir: "+yamlString(jinjaTemplate(st.workdir)))
+		}
+		e.task(fmt.Sprintf("Verify HEALTHCHECK %s", check.script()), when, true, "ansible.builtin.shell", yamlString(jinjaRaw(check.script())), nil, append(extra,
+			"register: machinefile_health",
+			"until: machinefile_health.rc == 0",
+			fmt.Sprintf("retries: %d", retries),
+			fmt.Sprintf("delay: %d", interval),
+			"changed_when: false",
+		))
+	}
+
+	// Platform ARGs need the facts of the host the playbook runs on
+	declared := e.df.DeclaredArgs()
+	for _, arg := range ansiblePlatformArgs {
+		if declared[arg.name] {
+			e.needFacts = true
+		}
+	}
+}
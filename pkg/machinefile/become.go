@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+const (
+	BecomeSudo = "sudo"
+	BecomeDoas = "doas"
+	BecomeSu   = "su"
+	BecomeNone = "none"
+)
+
+// Become describes how commands switch to another user on the target. By
+// default, steps run as the connecting user and USER switches with sudo.
+type Become struct {
+	Enabled  bool   // Run steps as root when no USER is set
+	Method   string // sudo, doas, su or none
+	Password string // Fed to the become method, never passed on a command line
+}
+
+// defaultBecome matches the behavior without any become options
+var defaultBecome = &Become{Method: BecomeSudo}
+
+// sudoPrompt is the prompt sudo prints when it reads the password from stdin.
+// The password is only written once this exact prompt appears, and the random
+// part keeps output of steps from matching it.
+var sudoPrompt = newSudoPrompt()
+
+func newSudoPrompt() string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	return fmt.Sprintf("[machinefile %x] password: ", nonce)
+}
+
+// ValidateBecomeMethod checks that a become method is supported
+func ValidateBecomeMethod(method string) error {
+	switch method {
+	case BecomeSudo, BecomeDoas, BecomeSu, BecomeNone:
+		return nil
+	}
+	return fmt.Errorf("unsupported become method %q, expected sudo, doas, su or none", method)
+}
+
+// targetUser returns the user a step should run as, or "" when the step runs
+// as the connecting user
+func (b *Become) targetUser(userName, currentUser string) string {
+	if userName == "" && b.Enabled {
+		userName = "root"
+	}
+	if userName == currentUser {
+		return ""
+	}
+	return userName
+}
+
+// command returns the command line that runs script with bash as userName,
+// which may be given as user, uid, user:group or uid:gid. currentUser is the
+// user the command is started as. When interactive is true, the password has
+// to be answered on a terminal instead of stdin.
+func (b *Become) command(userName, currentUser, script string, preserveEnv []string) (argv []string, interactive bool, err error) {
+	userName = b.targetUser(userName, currentUser)
+	if userName == "" {
+		return []string{"bash", "-c", script}, false, nil
+	}
+	spec, err := ParseUserSpec(userName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch b.Method {
+	case BecomeSudo:
+		argv = []string{"sudo"}
+		if b.Password != "" {
+			// Read the password from stdin after printing the prompt, and
+			// keep the step from reading stdin when sudo did not ask
+			argv = append(argv, "-S", "-p", sudoPrompt)
+			script = "exec </dev/null; " + script
+		}
+		if len(preserveEnv) > 0 {
+			argv = append(argv, "--preserve-env="+strings.Join(preserveEnv, ","))
+		}
+		// sudo takes numeric ids prefixed with #
+		argv = append(argv, "-u", sudoID(spec.User))
+		if spec.Group != "" {
+			argv = append(argv, "-g", sudoID(spec.Group))
+		}
+		argv = append(argv, "bash", "-c", script)
+		return argv, false, nil
+	case BecomeDoas:
+		if spec.Group != "" || isNumeric(spec.User) {
+			return nil, false, fmt.Errorf("cannot run as %s with become method doas, which only accepts user names", spec)
+		}
+		return []string{"doas", "-u", spec.User, "bash", "-c", script}, b.Password != "", nil
+	case BecomeSu:
+		if isNumeric(spec.User) {
+			return nil, false, fmt.Errorf("cannot run as uid %s with become method su, which only accepts user names", spec.User)
+		}
+		argv = []string{"su"}
+		if spec.Group != "" {
+			argv = append(argv, "--group", spec.Group)
+		}
+		argv = append(argv, spec.User, "-c", "bash -c "+shellQuote(script))
+		return argv, b.Password != "", nil
+	case BecomeNone:
+		return nil, false, fmt.Errorf("cannot run as user %s with become method none", spec)
+	}
+	return nil, false, ValidateBecomeMethod(b.Method)
+}
+
+func sudoID(id string) string {
+	if isNumeric(id) {
+		return "#" + id
+	}
+	return id
+}
+
+// run runs cmd, started for argv from command. A sudo command with a
+// password gets it on stdin only after printing sudoPrompt on stderr, so
+// nothing is written when sudo does not ask, like with cached credentials
+// or NOPASSWD.
+func (b *Become) run(cmd *exec.Cmd, argv []string) error {
+	if b.Password == "" || len(argv) == 0 || argv[0] != "sudo" {
+		return cmd.Run()
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out := cmd.Stderr
+	if out == nil {
+		out = io.Discard
+	}
+	answerer := &promptAnswerer{out: out, prompt: []byte(sudoPrompt), answer: func() error {
+		defer stdin.Close()
+		_, err := io.WriteString(stdin, b.Password+"\n")
+		return err
+	}}
+	cmd.Stderr = answerer
+	err = cmd.Run()
+	answerer.flush()
+	return err
+}
+
+// promptAnswerer passes output on to out, answering the first occurrence of
+// prompt, which is left out. Only output that may be the start of the prompt
+// is held back.
+type promptAnswerer struct {
+	out      io.Writer
+	prompt   []byte
+	answer   func() error
+	pending  []byte
+	answered bool
+}
+
+func (pa *promptAnswerer) Write(p []byte) (int, error) {
+	if pa.answered {
+		return pa.out.Write(p)
+	}
+	pa.pending = append(pa.pending, p...)
+	if i := bytes.Index(pa.pending, pa.prompt); i >= 0 {
+		pa.answered = true
+		rest := pa.pending[i+len(pa.prompt):]
+		if _, err := pa.out.Write(pa.pending[:i]); err != nil {
+			return 0, err
+		}
+		pa.pending = nil
+		if err := pa.answer(); err != nil {
+			return 0, err
+		}
+		if _, err := pa.out.Write(rest); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	// Hold back the longest end of the output that starts the prompt
+	keep := len(pa.prompt) - 1
+	if keep > len(pa.pending) {
+		keep = len(pa.pending)
+	}
+	for ; keep > 0; keep-- {
+		if bytes.HasPrefix(pa.prompt, pa.pending[len(pa.pending)-keep:]) {
+			break
+		}
+	}
+	if _, err := pa.out.Write(pa.pending[:len(pa.pending)-keep]); err != nil {
+		return 0, err
+	}
+	pa.pending = append([]byte(nil), pa.pending[len(pa.pending)-keep:]...)
+	return len(p), nil
+}
+
+// flush writes out output held back when the command exited
+func (pa *promptAnswerer) flush() {
+	pa.out.Write(pa.pending)
+	pa.pending = nil
+}
+
+// answerPasswordPrompt copies terminal output from r to out, answering a
+// password prompt of doas or su on w. Their prompt can not be chosen, so it
+// is only answered when the first line of output is a prompt ending in
+// "password:", which is left out. Output is held back until the first line
+// is complete or answered.
+func answerPasswordPrompt(r io.Reader, w io.Writer, out io.Writer, password string) error {
+	buf := make([]byte, 4096)
+	var firstLine []byte
+	scanning, echoed := true, false
+	for {
+		n, err := r.Read(buf)
+		output := buf[:n]
+		if echoed && n > 0 {
+			// Drop the newline echoed after the password
+			output = bytes.TrimPrefix(bytes.TrimPrefix(output, []byte("\r")), []byte("\n"))
+			echoed = false
+		}
+		if scanning && len(output) > 0 {
+			firstLine = append(firstLine, output...)
+			output = nil
+			if bytes.HasSuffix(bytes.ToLower(bytes.TrimRight(firstLine, " ")), []byte("password:")) {
+				if _, werr := io.WriteString(w, password+"\n"); werr != nil {
+					return werr
+				}
+				scanning, echoed, firstLine = false, true, nil
+			} else if bytes.ContainsAny(firstLine, "\r\n") {
+				scanning, output, firstLine = false, firstLine, nil
+			}
+		}
+		out.Write(output)
+		if err != nil {
+			out.Write(firstLine)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// shellQuote quotes a string for use as a single POSIX shell word
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, shellSafeChars) == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// shellSafeChars do not need quoting in a shell word
+const shellSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-"
+
+// shellJoin quotes and joins a command line for execution by a remote shell
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
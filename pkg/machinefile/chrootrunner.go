@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+type ChrootRunner struct {
+	BaseDir string
+	RootDir string // Path to the rootfs to provision
+	WorkDir string // Working directory of steps inside the rootfs, set by WORKDIR
+}
+
+// chrootMounts lists the host filesystems made available inside the rootfs
+// while a command runs
+var chrootMounts = []struct {
+	source string
+	target string
+	fstype string
+	flags  uintptr
+}{
+	{"proc", "proc", "proc", 0},
+	{"/sys", "sys", "", syscall.MS_BIND | syscall.MS_REC},
+	{"/dev", "dev", "", syscall.MS_BIND | syscall.MS_REC},
+}
+
+func (cr *ChrootRunner) RunCommand(command string, userName string, envVars map[string]string) error {
+	unmount, err := cr.mount()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	// The directory is changed to after entering the chroot
+	cmd.Dir = "/"
+	if cr.WorkDir != "" {
+		cmd.Dir = cr.WorkDir
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: cr.RootDir}
+
+	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	if userName != "" {
+		spec, err := ParseUserSpec(userName)
+		if err != nil {
+			return err
+		}
+		identity, err := cr.resolveUser(spec)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: identity.Uid, Gid: identity.Gid, Groups: identity.Groups}
+		cmd.Env = append(cmd.Env, "HOME="+identity.Home, "USER="+spec.User)
+	} else {
+		cmd.Env = append(cmd.Env, "HOME=/root", "USER=root")
+	}
+	cmd.Env = append(cmd.Env, sortedEnv(envVars)...)
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	fmt.Printf("Executing command in chroot %s: %s\n", cr.RootDir, command)
+	err = cmd.Run()
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			fmt.Fprintf(os.Stderr, "Error running command: %s, Exit Code: %d\n", command, exitError.ExitCode())
+		} else {
+			fmt.Fprintf(os.Stderr, "Error running command: %s, %v\n", command, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (cr *ChrootRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
+	return copyToRootfs(cr.BaseDir, cr.RootDir, srcPattern, dest, isAdd)
+}
+
+func (cr *ChrootRunner) setWorkdir(dir string) {
+	cr.WorkDir = dir
+}
+
+func (cr *ChrootRunner) resolveUser(spec UserSpec) (*Identity, error) {
+	accounts, err := loadRootfsAccounts(cr.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	return accounts.resolve(spec)
+}
+
+func (cr *ChrootRunner) probe(script string, input io.Reader) ([]byte, error) {
+	unmount, err := cr.mount()
+	if err != nil {
+		return nil, err
+	}
+	defer unmount()
+
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: cr.RootDir}
+	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	cmd.Stdin = input
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// mount makes /proc, /sys and /dev available in the rootfs and returns a
+// function that tears the mounts down again
+func (cr *ChrootRunner) mount() (func(), error) {
+	var mounted []string
+	unmount := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(mounted[i], syscall.MNT_DETACH); err != nil {
+				fmt.Fprintf(os.Stderr, "Error unmounting %s: %v\n", mounted[i], err)
+			}
+		}
+	}
+
+	for _, m := range chrootMounts {
+		target, err := resolveInRoot(cr.RootDir, m.target)
+		if err != nil {
+			unmount()
+			return nil, fmt.Errorf("error resolving mount point %s: %w", m.target, err)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			unmount()
+			return nil, fmt.Errorf("error creating mount point %s: %w", target, err)
+		}
+		if err := syscall.Mount(m.source, target, m.fstype, m.flags, ""); err != nil {
+			unmount()
+			return nil, fmt.Errorf("error mounting %s on %s: %w", m.source, target, err)
+		}
+		mounted = append(mounted, target)
+	}
+	return unmount, nil
+}
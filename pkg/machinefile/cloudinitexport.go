@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cloudInitContextDir is where the files of COPY and ADD are written on the
+// machine, before runcmd copies them in the order of the instructions
+const cloudInitContextDir = "/var/lib/machinefile/context"
+
+// cloudInitSizeLimit is the size of user data that all common clouds accept.
+// EC2 limits user data to 16 KiB, other clouds allow more.
+const cloudInitSizeLimit = 16 * 1024
+
+// cloudInitExporter converts a Dockerfile into cloud-init user data that
+// applies it when a machine first boots. Unlike the other formats, all
+// values are resolved at export time the way machinefile resolves them on
+// a run. Conditions that use facts of the machine are checked by runcmd,
+// which is only possible for instructions that add commands.
+type cloudInitExporter struct {
+	df      *Dockerfile
+	options ExportOptions
+
+	files  strings.Builder // Entries of write_files
+	runcmd strings.Builder // Entries of runcmd
+	copies int
+
+	// shell compiles conditions on facts into shell tests like the sh
+	// export, recording the helper functions they need
+	shell *shellExporter
+}
+
+// exportCloudInit writes the Dockerfile as a #cloud-config document
+func exportCloudInit(df *Dockerfile, options ExportOptions) (string, error) {
+	e := &cloudInitExporter{df: df, options: options, shell: &shellExporter{helpers: make(map[string]bool)}}
+	if unused := unusedArgs(df, options.Args); len(unused) > 0 {
+		options.warn("One or more build-args %v were not consumed", unused)
+	}
+	if err := e.run(); err != nil {
+		return "", err
+	}
+
+	document := e.document()
+	if len(document) > cloudInitSizeLimit {
+		options.warn("cloud-init user data is %d bytes, some clouds like EC2 accept at most %d bytes", len(document), cloudInitSizeLimit)
+	}
+	return document, nil
+}
+
+// run resolves the instructions like ParseAndRunDockerfile, recording the
+// steps instead of running them
+func (e *cloudInitExporter) run() error {
+	escape := e.df.EscapeToken
+	globalArgs := make(map[string]string)
+	for k, v := range e.options.Args {
+		if builtinArgs[k] {
+			globalArgs[k] = v
+		}
+	}
+	var current *stage
+	if !hasFrom(e.df.Instructions) {
+		current = newStage()
+	}
+	stages := make(map[string]*stage)
+
+	for _, inst := range e.df.Instructions {
+		runtimeCondition := false
+		if inst.When != "" {
+			if inst.Command == "FROM" {
+				return fmt.Errorf("FROM on line %d can not be conditional", inst.Line)
+			}
+			vars := globalArgs
+			if current != nil {
+				vars = current.vars()
+			}
+			node, err := parseCondition(inst.When)
+			if err != nil {
+				return fmt.Errorf("error in condition on line %d: %w", inst.Line, err)
+			}
+			if node.usesFacts() {
+				if err := e.startCondition(inst, node, vars); err != nil {
+					return err
+				}
+				runtimeCondition = true
+			} else if ok, err := EvaluateCondition(inst.When, vars, nil); err != nil {
+				return fmt.Errorf("error evaluating condition on line %d: %w", inst.Line, err)
+			} else if !ok {
+				e.comment("Skipped %s on line %d, condition is false: %s", inst.Command, inst.Line, inst.When)
+				continue
+			}
+		}
+
+		if inst.Command == "FROM" {
+			var err error
+			if current, err = startStage(io.Discard, inst, globalArgs, stages, escape); err != nil {
+				return err
+			}
+			continue
+		}
+		if current == nil {
+			if inst.Command != "ARG" {
+				return fmt.Errorf("%s on line %d must follow FROM", inst.Command, inst.Line)
+			}
+			if err := declareArgs(io.Discard, inst, escape, globalArgs, globalArgs, globalArgs, e.options.Args); err != nil {
+				return err
+			}
+			continue
+		}
+
+		vars := current.vars()
+		switch inst.Command {
+		case "RUN":
+			if err := e.step(inst.Args, current, vars); err != nil {
+				return err
+			}
+		case "COPY", "ADD":
+			words, err := processWords(inst, vars, escape)
+			if err != nil {
+				return err
+			}
+			if len(words) != 2 {
+				return fmt.Errorf("invalid %s command: %s", inst.Command, inst)
+			}
+			if err := e.copy(inst, words[0], workdirPath(current, words[1])); err != nil {
+				return err
+			}
+		case "USER":
+			userValue, err := processWord(inst.Args, vars, escape)
+			if err != nil {
+				return fmt.Errorf("invalid USER command on line %d: %w", inst.Line, err)
+			}
+			if _, err := ParseUserSpec(userValue); err != nil {
+				return err
+			}
+			current.User = userValue
+		case "ENV":
+			assignments, err := parseAssignments("ENV", inst.Args, vars, escape, true)
+			if err != nil {
+				return fmt.Errorf("invalid ENV command on line %d: %w", inst.Line, err)
+			}
+			for _, env := range assignments {
+				current.Env[env.Key] = env.Value
+			}
+		case "ARG":
+			if err := declareArgs(io.Discard, inst, escape, current.Args, vars, globalArgs, e.options.Args); err != nil {
+				return err
+			}
+		case "VOLUME":
+			volumes, err := processList(inst, vars, escape)
+			if err != nil {
+				return err
+			}
+			if len(volumes) == 0 {
+				return fmt.Errorf("VOLUME on line %d requires at least one path", inst.Line)
+			}
+			var quoted []string
+			for _, volume := range volumes {
+				quoted = append(quoted, shellQuote(volume))
+			}
+			e.command("mkdir -p " + strings.Join(quoted, " "))
+		case "HEALTHCHECK":
+			check, err := parseHealthcheck(inst.Args)
+			if err != nil {
+				return fmt.Errorf("invalid HEALTHCHECK command on line %d: %w", inst.Line, err)
+			}
+			current.Healthcheck = check
+		case "WORKDIR":
+			workdir, err := processWord(inst.Args, vars, escape)
+			if err != nil {
+				return fmt.Errorf("invalid WORKDIR command on line %d: %w", inst.Line, err)
+			}
+			if !filepath.IsAbs(workdir) {
+				workdir = filepath.Join(stageWorkdir(current), workdir)
+			}
+			e.command("mkdir -p " + shellQuote(workdir))
+			current.Workdir = workdir
+		case "ENTRYPOINT", "CMD":
+			command := parseExecCommand(inst.Args)
+			if inst.Command == "ENTRYPOINT" {
+				current.Entrypoint = &command
+			} else {
+				current.Cmd = &command
+			}
+			e.comment("%s on line %d is recorded for services, not applied at boot", inst.Command, inst.Line)
+		case "EXPOSE", "LABEL", "STOPSIGNAL":
+			e.comment("%s on line %d is recorded for services and the manifest, not applied at boot", inst.Command, inst.Line)
+		default:
+			e.comment("Unsupported command on line %d: %s", inst.Line, inst)
+		}
+		if runtimeCondition {
+			e.command("else")
+			e.command("printf '%s\\n' " + shellQuote(fmt.Sprintf("Skipping %s on line %d, condition is false: %s", inst.Command, inst.Line, inst.When)))
+			e.command("fi")
+		}
+	}
+
+	if e.copies > 0 {
+		e.command("rm -rf " + cloudInitContextDir)
+	}
+	if current != nil && current.Healthcheck != nil {
+		// Services are not installed, so there is nothing for a check of
+		// ENTRYPOINT and CMD to verify
+		if current.Entrypoint != nil || current.Cmd != nil {
+			e.comment("HEALTHCHECK is skipped, ENTRYPOINT and CMD are not run at boot")
+			return nil
+		}
+		return e.healthcheck(current.Healthcheck, current, current.vars())
+	}
+	return nil
+}
+
+// document assembles the header, write_files and runcmd
+func (e *cloudInitExporter) document() string {
+	var out strings.Builder
+	source := e.options.Source
+	if source == "" {
+		source = "a Containerfile"
+	}
+	out.WriteString("#cloud-config\n")
+	fmt.Fprintf(&out, "# Generated by machinefile %s from %s\n", e.options.Version, source)
+	fmt.Fprintf(&out, "#\n")
+	fmt.Fprintf(&out, "# Applies the steps when the machine first boots. Files of COPY and ADD are\n")
+	fmt.Fprintf(&out, "# written to %s and copied by runcmd, where RUN\n", cloudInitContextDir)
+	fmt.Fprintf(&out, "# steps run with bash as USER in the WORKDIR with the ARGs and ENVs\n")
+	fmt.Fprintf(&out, "# exported. ARG values were resolved at export time, conditions on facts\n")
+	fmt.Fprintf(&out, "# are checked by runcmd. No manifest is written.\n")
+	if e.files.Len() > 0 {
+		out.WriteString("write_files:\n")
+		out.WriteString(e.files.String())
+	}
+	out.WriteString("runcmd:\n")
+	out.WriteString("  - set -e\n")
+	// runcmd is run as a single script, so helpers are available to the
+	// entries after them
+	for _, helper := range shellHelpers {
+		if e.shell.helpers[helper.name] {
+			fmt.Fprintf(&out, "  - %s\n", yamlText(helper.code+"\n", "    "))
+		}
+	}
+	if e.shell.helpers["machinefile_gather_facts"] {
+		fmt.Fprintf(&out, "  - %s\n", yamlString("machinefile_gather_facts "+shellQuote(factsScript)))
+	}
+	out.WriteString(e.runcmd.String())
+	return out.String()
+}
+
+// command adds a shell command to runcmd
+func (e *cloudInitExporter) command(command string) {
+	fmt.Fprintf(&e.runcmd, "  - %s\n", yamlString(command))
+}
+
+// comment records an instruction without a command in runcmd
+func (e *cloudInitExporter) comment(format string, args ...interface{}) {
+	text := strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", " ")
+	fmt.Fprintf(&e.runcmd, "  # %s\n", text)
+}
+
+// startCondition starts checking a condition that uses facts in runcmd, as
+// the facts are only known on the machine. Variables are resolved at export
+// time like all other values, so only instructions that add commands can be
+// skipped at boot.
+func (e *cloudInitExporter) startCondition(inst *Instruction, node *conditionNode, vars map[string]string) error {
+	switch inst.Command {
+	case "RUN", "COPY", "ADD", "VOLUME":
+	default:
+		return fmt.Errorf("condition of %s on line %d uses facts, which are only known at boot, so only RUN, COPY, ADD and VOLUME can use them", inst.Command, inst.Line)
+	}
+	e.command("if " + e.shell.condition(node.resolveVariables(vars)) + "; then")
+	return nil
+}
+
+// step adds a command that runs with bash as the USER in the WORKDIR of the
+// stage, like the runners run steps. runcmd runs as root, which switches to
+// USER with sudo.
+func (e *cloudInitExporter) step(command string, st *stage, envVars map[string]string) error {
+	argv, _, err := defaultBecome.command(st.User, "root", envExports(envVars)+workdirPrefix(st.Workdir)+command, nil)
+	if err != nil {
+		return err
+	}
+	e.command(shellJoin(argv))
+	return nil
+}
+
+// copy writes the matches of a source with write_files and copies them to
+// the destination like LocalRunner does
+func (e *cloudInitExporter) copy(inst *Instruction, pattern, dest string) error {
+	sources, err := readContextSources(e.options.ContextDir, pattern)
+	if err != nil {
+		return fmt.Errorf("error reading %s source on line %d: %w", inst.Command, inst.Line, err)
+	}
+
+	e.copies++
+	dest = filepath.Clean(dest)
+	for i, source := range sources {
+		src := path.Join(cloudInitContextDir, fmt.Sprintf("%d-%d", e.copies, i), source.Name)
+		size := 0
+		var setup []string
+		for _, file := range source.Files {
+			target := src
+			if file.Path != "." {
+				target = path.Join(src, file.Path)
+			}
+			switch {
+			case file.Target != "":
+				setup = append(setup, fmt.Sprintf("mkdir -p %s && ln -s %s %s", shellQuote(path.Dir(target)), shellQuote(file.Target), shellQuote(target)))
+			case file.Mode.IsDir():
+				setup = append(setup, fmt.Sprintf("mkdir -p %s && chmod %o %s", shellQuote(target), file.Mode.Perm(), shellQuote(target)))
+			default:
+				size += len(file.Content)
+				e.writeFile(target, file)
+			}
+		}
+		if size > cloudInitSizeLimit {
+			e.options.warn("%s source %s on line %d adds %d bytes to the user data", inst.Command, source.Name, inst.Line, size)
+		}
+
+		for _, command := range setup {
+			e.command(command)
+		}
+		switch {
+		case source.IsDir && inst.Command == "ADD":
+			e.command(fmt.Sprintf("mkdir -p %s && cp -a %s/* %s/", shellQuote(dest), shellQuote(src), shellQuote(dest)))
+		case source.IsDir:
+			e.command(fmt.Sprintf("cp -a %s %s", shellQuote(src), shellQuote(dest)))
+		default:
+			e.command(fmt.Sprintf("cp -p %s %s", shellQuote(src), shellQuote(dest)))
+		}
+	}
+	return nil
+}
+
+// writeFile adds a file to write_files, compressed when that makes it
+// smaller
+func (e *cloudInitExporter) writeFile(target string, file contextFile) {
+	encoding, content := "b64", file.Content
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(file.Content)
+	gz.Close()
+	if compressed.Len() < len(file.Content) {
+		encoding, content = "gz+b64", compressed.Bytes()
+	}
+
+	fmt.Fprintf(&e.files, "  - path: %s\n", yamlString(target))
+	fmt.Fprintf(&e.files, "    permissions: \"%04o\"\n", file.Mode.Perm())
+	fmt.Fprintf(&e.files, "    encoding: %s\n", encoding)
+	fmt.Fprintf(&e.files, "    content: %s\n", base64.StdEncoding.EncodeToString(content))
+}
+
+// healthcheck verifies the health check of the final stage, retrying every
+// interval, with extra retries for the start period
+func (e *cloudInitExporter) healthcheck(check *healthcheck, st *stage, envVars map[string]string) error {
+	argv, _, err := defaultBecome.command(st.User, "root", envExports(envVars)+workdirPrefix(st.Workdir)+check.script(), nil)
+	if err != nil {
+		return err
+	}
+	interval := shellSeconds(check.Interval)
+	retries := check.Retries + int(math.Ceil(check.StartPeriod.Seconds()/float64(interval)))
+	e.command(fmt.Sprintf("attempt=1; until %s; do [ $attempt -lt %d ] || exit 1; attempt=$((attempt + 1)); sleep %d; done",
+		shellJoin(argv), retries, interval))
+	return nil
+}
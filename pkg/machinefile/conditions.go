@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// whenDirectivePrefix starts a comment that makes the next instruction
+// conditional, like "# machinefile: when=distro == fedora". Container
+// engines ignore it as a comment.
+const whenDirectivePrefix = "machinefile:"
+
+// parseWhenDirective returns the condition of a "# machinefile: when=..."
+// comment line
+func parseWhenDirective(line string) (string, bool) {
+	comment := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+	rest, ok := strings.CutPrefix(comment, whenDirectivePrefix)
+	if !ok {
+		return "", false
+	}
+	condition, ok := strings.CutPrefix(strings.TrimSpace(rest), "when=")
+	if !ok {
+		return "", false
+	}
+	condition = strings.TrimSpace(condition)
+	if len(condition) >= 2 && (condition[0] == '"' || condition[0] == '\'') && condition[len(condition)-1] == condition[0] {
+		condition = condition[1 : len(condition)-1]
+	}
+	return condition, true
+}
+
+// factVars returns the facts usable by name in conditions
+func factVars(f *Facts) map[string]string {
+	if f == nil {
+		return nil
+	}
+	return map[string]string{
+		"hostname":        f.Hostname,
+		"os":              f.OS,
+		"kernel":          f.Kernel,
+		"arch":            f.Architecture,
+		"variant":         f.Variant,
+		"distro":          f.Distro.ID,
+		"distro_like":     strings.Join(f.Distro.IDLike, " "),
+		"distro_version":  f.Distro.Version,
+		"cpus":            strconv.Itoa(f.CPUs),
+		"memory_mb":       strconv.FormatInt(f.MemoryMB, 10),
+		"package_manager": f.PackageManager,
+		"init_system":     f.InitSystem,
+		"container":       f.Container,
+		"is_container":    strconv.FormatBool(f.IsContainer),
+		"firewall":        f.Firewall,
+	}
+}
+
+// knownFacts lists the fact names, so they are not taken for plain words when
+// facts could not be gathered
+var knownFacts = factVars(&Facts{})
+
+// EvaluateCondition evaluates a condition over facts and the ARG and ENV
+// variables in vars.
+//
+// Facts are referenced by name, like distro or arch, variables as $NAME or
+// ${NAME}, and other words or quoted strings are literals. Fact names are
+// reserved, so a word equal to one has to be quoted to be a literal. Values are
+// compared with ==, !=, <, <=, >, >= (numeric or version aware), =~ and !~
+// (regular expressions), and combined with &&, ||, ! and parentheses. A
+// value on its own is true unless it is empty, 0 or false.
+func EvaluateCondition(condition string, vars map[string]string, facts *Facts) (bool, error) {
+	node, err := parseCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	result, err := node.evaluate(vars, factVars(facts))
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %w", condition, err)
+	}
+	return truthy(result), nil
+}
+
+// Kinds of values in a condition
+const (
+	conditionLiteral  = "literal"
+	conditionVariable = "variable"
+	conditionFact     = "fact"
+)
+
+// conditionNode is a node of a parsed condition. Operators are ||, &&, ! and
+// the comparisons; nodes without an operator are values of a kind.
+type conditionNode struct {
+	Operator    string
+	Left, Right *conditionNode // Right is nil for !
+	Kind        string
+	Value       string // Text of a literal, or name of a variable or fact
+}
+
+// usesFacts reports whether the value of a condition depends on facts
+func (n *conditionNode) usesFacts() bool {
+	if n == nil {
+		return false
+	}
+	return n.Kind == conditionFact || n.Left.usesFacts() || n.Right.usesFacts()
+}
+
+// resolveVariables returns a copy of a condition with its variables replaced
+// by their values
+func (n *conditionNode) resolveVariables(vars map[string]string) *conditionNode {
+	if n == nil {
+		return nil
+	}
+	if n.Operator == "" && n.Kind == conditionVariable {
+		return &conditionNode{Kind: conditionLiteral, Value: vars[n.Value]}
+	}
+	resolved := *n
+	resolved.Left = n.Left.resolveVariables(vars)
+	resolved.Right = n.Right.resolveVariables(vars)
+	return &resolved
+}
+
+// parseCondition parses a condition into its syntax tree
+func parseCondition(condition string) (*conditionNode, error) {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return nil, err
+	}
+	p := &conditionParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", condition, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid condition %q: unexpected %q", condition, p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+// evaluate returns the value of a node, which is "true" or "false" for
+// operators
+func (n *conditionNode) evaluate(vars, facts map[string]string) (string, error) {
+	switch n.Operator {
+	case "":
+		switch n.Kind {
+		case conditionVariable:
+			return vars[n.Value], nil
+		case conditionFact:
+			if facts == nil {
+				return "", fmt.Errorf("fact %s is not available", n.Value)
+			}
+			return facts[n.Value], nil
+		}
+		return n.Value, nil
+	case "!":
+		value, err := n.Left.evaluate(vars, facts)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(!truthy(value)), nil
+	}
+
+	left, err := n.Left.evaluate(vars, facts)
+	if err != nil {
+		return "", err
+	}
+	// || and && only evaluate the right side when needed, like in a shell
+	switch n.Operator {
+	case "||":
+		if truthy(left) {
+			return "true", nil
+		}
+	case "&&":
+		if !truthy(left) {
+			return "false", nil
+		}
+	}
+	right, err := n.Right.evaluate(vars, facts)
+	if err != nil {
+		return "", err
+	}
+	switch n.Operator {
+	case "||", "&&":
+		return strconv.FormatBool(truthy(right)), nil
+	}
+	result, err := compareValues(left, n.Operator, right)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatBool(result), nil
+}
+
+type conditionToken struct {
+	text    string
+	literal bool // Quoted string, never an operator or name
+}
+
+var conditionOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")"}
+
+func tokenizeCondition(condition string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	input := []rune(condition)
+	for i := 0; i < len(input); {
+		ch := input[i]
+		if unicode.IsSpace(ch) {
+			i++
+			continue
+		}
+		if ch == '"' || ch == '\'' {
+			end := i + 1
+			for end < len(input) && input[end] != ch {
+				end++
+			}
+			if end >= len(input) {
+				return nil, fmt.Errorf("unterminated string in condition %q", condition)
+			}
+			tokens = append(tokens, conditionToken{text: string(input[i+1 : end]), literal: true})
+			i = end + 1
+			continue
+		}
+		operator := ""
+		for _, op := range conditionOperators {
+			if strings.HasPrefix(string(input[i:]), op) {
+				operator = op
+				break
+			}
+		}
+		if operator != "" {
+			tokens = append(tokens, conditionToken{text: operator})
+			i += len([]rune(operator))
+			continue
+		}
+		start := i
+		for i < len(input) && !unicode.IsSpace(input[i]) && !strings.ContainsRune("()!=<>&|~\"'", input[i]) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("unexpected %q in condition %q", input[i], condition)
+		}
+		tokens = append(tokens, conditionToken{text: string(input[start:i])})
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].literal {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *conditionParser) parseOr() (*conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &conditionNode{Operator: "||", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (*conditionNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &conditionNode{Operator: "&&", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (*conditionNode, error) {
+	if p.peek() == "!" {
+		p.pos++
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &conditionNode{Operator: "!", Left: node}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (*conditionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch operator := p.peek(); operator {
+	case "==", "!=", "=~", "!~", "<", "<=", ">", ">=":
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if operator == "=~" || operator == "!~" {
+			// Check literal expressions when parsing, others when evaluated
+			if right.Kind == conditionLiteral {
+				if _, err := regexp.Compile(right.Value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return &conditionNode{Operator: operator, Left: left, Right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parsePrimary() (*conditionNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	if token.literal {
+		return &conditionNode{Kind: conditionLiteral, Value: token.text}, nil
+	}
+
+	switch token.text {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	case ")", "&&", "||", "==", "!=", "=~", "!~", "<", "<=", ">", ">=", "!":
+		return nil, fmt.Errorf("unexpected %q", token.text)
+	}
+
+	if strings.HasPrefix(token.text, "$") {
+		name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(token.text, "$"), "{"), "}")
+		return &conditionNode{Kind: conditionVariable, Value: name}, nil
+	}
+	if _, ok := knownFacts[token.text]; ok {
+		return &conditionNode{Kind: conditionFact, Value: token.text}, nil
+	}
+	return &conditionNode{Kind: conditionLiteral, Value: token.text}, nil
+}
+
+func compareValues(left, operator, right string) (bool, error) {
+	switch operator {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "=~", "!~":
+		re, err := regexp.Compile(right)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(left) == (operator == "=~"), nil
+	}
+
+	order := compareVersions(left, right)
+	switch operator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	default:
+		return order >= 0, nil
+	}
+}
+
+// compareVersions compares dotted versions numerically by component, falling
+// back to comparing text for components that are not numbers
+func compareVersions(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var partA, partB string
+		if i < len(partsA) {
+			partA = partsA[i]
+		}
+		if i < len(partsB) {
+			partB = partsB[i]
+		}
+		numA, errA := strconv.Atoi(partA)
+		numB, errB := strconv.Atoi(partB)
+		if errA == nil && errB == nil {
+			if numA != numB {
+				if numA < numB {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(partA, partB); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func truthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
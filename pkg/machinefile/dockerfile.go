@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Instruction is a single logical instruction of a Dockerfile, with
+// continuation lines joined
+type Instruction struct {
+	Command  string // Instruction name in upper case, like RUN
+	Args     string // Arguments following the instruction name
+	Line     int    // Line number the instruction starts on
+	Original string // Instruction as written, including continuation lines
+	When     string // Condition from a "# machinefile: when=" comment
+
+	// Comments are the comment lines before the instruction, with an empty
+	// string for each empty line
+	Comments []string
+	// Lines are the lines of the instruction without the instruction name,
+	// leading whitespace and continuation escapes. The whitespace before an
+	// escape is kept, as it is part of Args, and so are comment lines between
+	// continuation lines.
+	Lines []string
+}
+
+func (inst *Instruction) String() string {
+	return inst.Command + " " + inst.Args
+}
+
+// Dockerfile is a parsed Dockerfile with the parser directives from the top
+// of the file
+type Dockerfile struct {
+	EscapeToken  rune     // Escape character from the escape directive
+	Syntax       string   // Frontend image from the syntax directive, which is not used
+	CheckSkip    []string // Lint checks skipped by the check directive
+	CheckError   bool     // Lint warnings fail the check, from the check directive
+	Instructions []*Instruction
+
+	Header   []string // Shebang and parser directive lines as written
+	Trailing []string // Comment and empty lines after the last instruction
+}
+
+// directivePattern matches parser directives like "# escape=`"
+var directivePattern = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.*?)\s*$`)
+
+// ReadDockerfile parses the Dockerfile at path
+func ReadDockerfile(path string) (*Dockerfile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Dockerfile: %w", err)
+	}
+	defer file.Close()
+	return ParseDockerfile(file)
+}
+
+// ParseDockerfile reads the directives and instructions from a Dockerfile.
+// Like Docker, directives are only recognized at the top of the file, before
+// any other line, but after a shebang line. Comments and empty lines are
+// skipped, also between continuation lines.
+func ParseDockerfile(r io.Reader) (*Dockerfile, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	df := &Dockerfile{EscapeToken: DefaultEscapeToken}
+	seenDirectives := make(map[string]bool)
+	inDirectives := true
+
+	var current *Instruction
+	var args, original strings.Builder
+	var conditions, comments []string
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+
+		if inDirectives {
+			if lineNumber == 1 && strings.HasPrefix(line, "#!") {
+				df.Header = append(df.Header, line)
+				continue
+			}
+			if match := directivePattern.FindStringSubmatch(line); match != nil {
+				name := strings.ToLower(match[1])
+				if seenDirectives[name] {
+					return nil, fmt.Errorf("only one %s parser directive can be used (line %d)", name, lineNumber)
+				}
+				seenDirectives[name] = true
+				if err := df.setDirective(name, match[2]); err != nil {
+					return nil, fmt.Errorf("invalid %s parser directive on line %d: %w", name, lineNumber, err)
+				}
+				df.Header = append(df.Header, line)
+				continue
+			}
+			inDirectives = false
+		}
+
+		if line == "" {
+			if current == nil {
+				comments = append(comments, line)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if current != nil {
+				current.Lines = append(current.Lines, line)
+				continue
+			}
+			if condition, ok := parseWhenDirective(line); ok {
+				conditions = append(conditions, condition)
+			}
+			comments = append(comments, line)
+			continue
+		}
+
+		if current == nil {
+			command, rest := line, ""
+			if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+				command, rest = line[:i], line[i:]
+			}
+			current = &Instruction{Command: strings.ToUpper(command), Line: lineNumber}
+			current.When = joinConditions(conditions)
+			current.Comments = comments
+			conditions, comments = nil, nil
+			line = strings.TrimSpace(rest)
+			args.Reset()
+			original.Reset()
+		} else {
+			original.WriteString("\n")
+		}
+		original.WriteString(raw)
+
+		if strings.HasSuffix(line, string(df.EscapeToken)) {
+			line = strings.TrimSuffix(line, string(df.EscapeToken))
+			current.Lines = append(current.Lines, line)
+			args.WriteString(line)
+			args.WriteString(" ")
+			continue
+		}
+		current.Lines = append(current.Lines, line)
+		args.WriteString(line)
+		current.Args = strings.TrimSpace(args.String())
+		current.Original = original.String()
+		df.Instructions = append(df.Instructions, current)
+		current = nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading Dockerfile: %w", err)
+	}
+	if current != nil {
+		return nil, fmt.Errorf("%s command on line %d not properly terminated", current.Command, current.Line)
+	}
+	df.Trailing = comments
+	return df, nil
+}
+
+// setDirective applies a parser directive. Unknown directives are ignored
+// like Docker does.
+func (df *Dockerfile) setDirective(name, value string) error {
+	switch name {
+	case "escape":
+		if value != "\\" && value != "`" {
+			return fmt.Errorf("invalid escape token %q, must be \\ or `", value)
+		}
+		df.EscapeToken = rune(value[0])
+	case "syntax":
+		df.Syntax = value
+	case "check":
+		for _, option := range strings.Split(value, ";") {
+			key, optionValue, _ := strings.Cut(strings.TrimSpace(option), "=")
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "skip":
+				for _, check := range strings.Split(optionValue, ",") {
+					if check = strings.TrimSpace(check); check != "" {
+						df.CheckSkip = append(df.CheckSkip, check)
+					}
+				}
+			case "error":
+				df.CheckError = strings.EqualFold(strings.TrimSpace(optionValue), "true")
+			case "":
+			default:
+				return fmt.Errorf("unknown check option %q", key)
+			}
+		}
+	}
+	return nil
+}
+
+// UnsupportedFeatures describes the features of newer Dockerfile syntax
+// used in the file that machinefile does not support
+func (df *Dockerfile) UnsupportedFeatures() []string {
+	var features []string
+	for _, inst := range df.Instructions {
+		for _, feature := range inst.unsupportedFeatures() {
+			features = append(features, fmt.Sprintf("%s on line %d", feature, inst.Line))
+		}
+	}
+	return features
+}
+
+// unsupportedFeatures describes the unsupported features used by an
+// instruction
+func (inst *Instruction) unsupportedFeatures() []string {
+	var features []string
+	switch inst.Command {
+	case "RUN", "COPY", "ADD":
+		if heredocPattern.MatchString(inst.Args) {
+			features = append(features, fmt.Sprintf("here-documents in %s", inst.Command))
+		}
+		for _, flag := range instructionFlags(inst.Args) {
+			features = append(features, fmt.Sprintf("%s %s", inst.Command, flag))
+		}
+	}
+	return features
+}
+
+// heredocPattern matches the start of a here-document like <<EOF or <<-"EOF"
+var heredocPattern = regexp.MustCompile(`(^|\s)<<-?["']?[A-Za-z_][A-Za-z0-9_]*["']?(\s|$)`)
+
+// instructionFlags returns the leading --flag options of instruction
+// arguments, like --mount=type=cache in RUN
+func instructionFlags(args string) []string {
+	var flags []string
+	for _, word := range strings.Fields(args) {
+		if !strings.HasPrefix(word, "--") {
+			break
+		}
+		name, _, _ := strings.Cut(word, "=")
+		flags = append(flags, name)
+	}
+	return flags
+}
+
+// joinConditions combines the conditions of several when directives
+func joinConditions(conditions []string) string {
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	var joined []string
+	for _, condition := range conditions {
+		joined = append(joined, "("+condition+")")
+	}
+	return strings.Join(joined, " && ")
+}
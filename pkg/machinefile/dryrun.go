@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+)
+
+// DryRunner wraps a runner to print the steps of a Machinefile instead of
+// running them. Users are still resolved and facts gathered on the target.
+type DryRunner struct {
+	Runner  Runner
+	WorkDir string // Working directory steps would run in, set by WORKDIR
+}
+
+func (dr *DryRunner) RunCommand(command string, userName string, envVars map[string]string) error {
+	if userName == "" {
+		userName = "default user"
+	}
+	if dr.WorkDir != "" {
+		fmt.Fprintf(dr.stdout(), "Would execute as %s in %s: %s\n", userName, dr.WorkDir, command)
+		return nil
+	}
+	fmt.Fprintf(dr.stdout(), "Would execute as %s: %s\n", userName, command)
+	return nil
+}
+
+func (dr *DryRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
+	instruction := "COPY"
+	if isAdd {
+		instruction = "ADD"
+	}
+	fmt.Fprintf(dr.stdout(), "Would %s %s to %s\n", instruction, srcPattern, dest)
+	return nil
+}
+
+func (dr *DryRunner) setWorkdir(dir string) {
+	dr.WorkDir = dir
+}
+
+func (dr *DryRunner) resolveUser(spec UserSpec) (*Identity, error) {
+	resolver, ok := dr.Runner.(userResolver)
+	if !ok {
+		return nil, fmt.Errorf("runner does not support resolving users")
+	}
+	return resolver.resolveUser(spec)
+}
+
+func (dr *DryRunner) stdout() io.Writer {
+	return runnerStdout(dr.Runner)
+}
+
+func (dr *DryRunner) stderr() io.Writer {
+	return runnerStderr(dr.Runner)
+}
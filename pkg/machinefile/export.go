@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExportOptions select what is included when exporting a Dockerfile
+type ExportOptions struct {
+	Source     string            // Path of the Dockerfile, recorded in the output
+	ContextDir string            // Directory COPY and ADD sources are read from
+	Args       map[string]string // ARG values given at export time, like --arg
+	Version    string            // Version of machinefile, recorded in the output
+	Warnings   io.Writer         // Receives warnings about the conversion, if not nil
+}
+
+// ExportFormats lists the formats a Dockerfile can be exported to
+var ExportFormats = []string{"sh", "ansible", "cloud-init"}
+
+// Export writes the Dockerfile in another format, so it can be applied
+// without machinefile
+func Export(df *Dockerfile, format string, options ExportOptions, w io.Writer) error {
+	var output string
+	var err error
+	switch format {
+	case "sh":
+		output, err = exportShell(df, options)
+	case "ansible":
+		output, err = exportAnsible(df, options)
+	case "cloud-init":
+		output, err = exportCloudInit(df, options)
+	default:
+		return fmt.Errorf("unsupported export format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, output)
+	return err
+}
+
+// contextFile is a file, directory or symbolic link of a COPY or ADD source
+// read from the context
+type contextFile struct {
+	Path    string // Path relative to the source, "." for the source itself
+	Mode    os.FileMode
+	ModTime int64 // Modification time in seconds since the epoch
+	Content []byte
+	Target  string // Target of a symbolic link
+}
+
+// contextSource is a match of a COPY or ADD source pattern with its files
+type contextSource struct {
+	Name  string // Base name of the match
+	Path  string // Path of the match
+	IsDir bool
+	Files []contextFile
+}
+
+// readContextSources matches a source pattern against the context like the
+// runners do and reads the matched files
+func readContextSources(contextDir, pattern string) ([]contextSource, error) {
+	matches, err := filepath.Glob(filepath.Clean(filepath.Join(contextDir, pattern)))
+	if err != nil {
+		return nil, fmt.Errorf("error with glob pattern: %w", err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no matches found for pattern: %s", pattern)
+	}
+
+	var sources []contextSource
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+		source := contextSource{Name: filepath.Base(match), Path: match, IsDir: info.IsDir()}
+		err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(match, path)
+			if err != nil {
+				return err
+			}
+			file := contextFile{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime().Unix()}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				if file.Target, err = os.Readlink(path); err != nil {
+					return err
+				}
+			case info.Mode().IsRegular():
+				if file.Content, err = os.ReadFile(path); err != nil {
+					return err
+				}
+			case !info.IsDir():
+				return fmt.Errorf("unsupported file type of %s", path)
+			}
+			source.Files = append(source.Files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// warn writes a warning about the conversion
+func (options ExportOptions) warn(format string, args ...interface{}) {
+	if options.Warnings != nil {
+		fmt.Fprintf(options.Warnings, "[Warning] "+format+"\n", args...)
+	}
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Firewalls EXPOSE can be applied to
+const (
+	FirewallFirewalld = "firewalld"
+	FirewallNftables  = "nftables"
+)
+
+// exposedPort is a port or port range from EXPOSE, like 8080/tcp
+type exposedPort struct {
+	Ports    string // Port or range like 8000-8010
+	Protocol string // tcp or udp
+}
+
+func (p exposedPort) String() string {
+	return p.Ports + "/" + p.Protocol
+}
+
+// parseExposedPorts parses the words of EXPOSE after variable expansion
+func parseExposedPorts(words []string) ([]exposedPort, error) {
+	var ports []exposedPort
+	for _, word := range words {
+		portRange, protocol, _ := strings.Cut(word, "/")
+		protocol = strings.ToLower(protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+			return nil, fmt.Errorf("invalid protocol in EXPOSE %s", word)
+		}
+		for _, port := range strings.SplitN(portRange, "-", 2) {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("invalid port in EXPOSE %s", word)
+			}
+		}
+		ports = append(ports, exposedPort{Ports: portRange, Protocol: protocol})
+	}
+	return ports, nil
+}
+
+// nftInputChains lists the family, table and name of the nftables base
+// chains filtering the input hook of the host
+const nftInputChains = `nft list chains | awk '$1 == "table" { family = $2; table = $3 } $1 == "chain" { chain = $2 } /type filter hook input/ && family ~ /^(ip|ip6|inet)$/ { print family, table, chain }'`
+
+// firewallScript returns a script that opens the ports with the firewall,
+// skipping ports that are already open so it can be run repeatedly
+func firewallScript(firewall string, ports []exposedPort) (string, error) {
+	var script []string
+	switch firewall {
+	case FirewallFirewalld:
+		for _, port := range ports {
+			for _, permanent := range []string{"", " --permanent"} {
+				script = append(script, fmt.Sprintf("{ firewall-cmd%s --query-port=%s >/dev/null || firewall-cmd%s --add-port=%s; }",
+					permanent, port, permanent, port))
+			}
+		}
+	case FirewallNftables:
+		// A packet accepted by one base chain of the input hook is still
+		// checked by the others, like the INPUT chain of iptables-nft, so
+		// the rules are inserted at the top of each of them
+		var rules []string
+		for _, port := range ports {
+			rule := shellQuote(fmt.Sprintf("%s dport %s accept comment \"machinefile\"", port.Protocol, port.Ports))
+			rules = append(rules, fmt.Sprintf(`{ nft list chain "$family" "$table" "$chain" | grep -qF %[1]s || nft insert rule "$family" "$table" "$chain" %[1]s; }`, rule))
+		}
+		script = append(script, nftInputChains+" | while read -r family table chain; do "+strings.Join(rules, " && ")+" || exit; done")
+	default:
+		return "", fmt.Errorf("unsupported firewall %q", firewall)
+	}
+	return strings.Join(script, " && "), nil
+}
+
+// applyExpose opens the exposed ports in the firewall of the target, as
+// detected in its facts, through the runner as the connecting user
+func applyExpose(runner Runner, ports []exposedPort, facts *Facts) error {
+	out := runnerStdout(runner)
+	if len(ports) == 0 {
+		return nil
+	}
+	if facts == nil {
+		return fmt.Errorf("unable to apply EXPOSE without facts of the target")
+	}
+	if facts.Firewall == "" {
+		fmt.Fprintf(out, "No running firewalld or nftables ruleset found on target, EXPOSE %s not applied\n", formatPorts(ports))
+		return nil
+	}
+
+	script, err := firewallScript(facts.Firewall, ports)
+	if err != nil {
+		return err
+	}
+	if err := runner.RunCommand(script, "", nil); err != nil {
+		return fmt.Errorf("error applying EXPOSE with %s: %w", facts.Firewall, err)
+	}
+	fmt.Fprintf(out, "Opened %s with %s\n", formatPorts(ports), facts.Firewall)
+	return nil
+}
+
+func formatPorts(ports []exposedPort) string {
+	var formatted []string
+	for _, port := range ports {
+		formatted = append(formatted, port.String())
+	}
+	return strings.Join(formatted, " ")
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// prober is implemented by runners that can run a script on the target as
+// the connecting user and capture its output, to gather facts about it. The
+// script reads input from stdin, so it is neither printed nor put on a
+// command line.
+type prober interface {
+	probe(script string, input io.Reader) ([]byte, error)
+}
+
+// factsScript prints facts about the target as key=value lines, followed by
+// the os-release file after a separator line
+const factsScript = `uname -s >/dev/null || exit 1
+echo "os=$(uname -s)"
+echo "machine=$(uname -m)"
+echo "hostname=$(uname -n)"
+echo "kernel=$(uname -r)"
+echo "cpus=$(getconf _NPROCESSORS_ONLN 2>/dev/null || grep -c ^processor /proc/cpuinfo 2>/dev/null)"
+echo "memory_kb=$(awk '/^MemTotal:/ { print $2 }' /proc/meminfo 2>/dev/null)"
+for pm in dnf yum apt-get apk zypper pacman; do
+  if command -v $pm >/dev/null 2>&1; then echo "package_manager=$pm"; break; fi
+done
+if [ -d /run/systemd/system ]; then init=systemd
+elif command -v openrc >/dev/null 2>&1; then init=openrc
+else init=$(cat /proc/1/comm 2>/dev/null); fi
+echo "init_system=$init"
+container=$(systemd-detect-virt --container 2>/dev/null)
+[ "$container" = none ] && container=
+[ -z "$container" ] && [ -f /run/.containerenv ] && container=podman
+[ -z "$container" ] && [ -f /.dockerenv ] && container=docker
+[ -z "$container" ] && container=$(tr '\0' '\n' </proc/1/environ 2>/dev/null | sed -n 's/^container=//p')
+echo "container=$container"
+if command -v firewall-cmd >/dev/null 2>&1 && firewall-cmd --state >/dev/null 2>&1; then echo "firewall=firewalld"
+elif command -v nft >/dev/null 2>&1 && nft list chains 2>/dev/null | grep -q "hook input"; then echo "firewall=nftables"; fi
+echo "---"
+cat /etc/os-release 2>/dev/null || cat /usr/lib/os-release 2>/dev/null
+true`
+
+// Distro describes the distribution from os-release
+type Distro struct {
+	ID         string   `json:"id"`
+	IDLike     []string `json:"id_like,omitempty"`
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	PrettyName string   `json:"pretty_name"`
+}
+
+// Facts describes the target a Machinefile runs on
+type Facts struct {
+	Hostname       string `json:"hostname"`
+	OS             string `json:"os"`
+	Kernel         string `json:"kernel"`
+	Machine        string `json:"machine"`      // Machine as reported by uname -m
+	Architecture   string `json:"architecture"` // Architecture in GOARCH notation
+	Variant        string `json:"variant,omitempty"`
+	Distro         Distro `json:"distro"`
+	CPUs           int    `json:"cpus"`
+	MemoryMB       int64  `json:"memory_mb"`
+	PackageManager string `json:"package_manager"` // dnf, yum, apt, apk, zypper or pacman
+	InitSystem     string `json:"init_system"`
+	Container      string `json:"container,omitempty"` // Container technology, like podman
+	IsContainer    bool   `json:"is_container"`
+	Firewall       string `json:"firewall,omitempty"` // Running firewalld, or nftables with an input chain
+}
+
+// Platform returns the platform of the target
+func (f *Facts) Platform() *Platform {
+	return &Platform{
+		OS:            f.OS,
+		Architecture:  f.Architecture,
+		Variant:       f.Variant,
+		Hostname:      f.Hostname,
+		DistroID:      f.Distro.ID,
+		DistroVersion: f.Distro.Version,
+	}
+}
+
+// factsCache holds the facts of each runner, so targets are probed only once
+// per run
+var factsCache sync.Map
+
+// GatherFacts probes the target of runner, or returns the facts gathered
+// earlier in this run
+func GatherFacts(runner Runner) (*Facts, error) {
+	if dr, ok := runner.(*DryRunner); ok {
+		runner = dr.Runner
+	}
+	if cached, ok := factsCache.Load(runner); ok {
+		return cached.(*Facts), nil
+	}
+
+	p, ok := runner.(prober)
+	if !ok {
+		return nil, fmt.Errorf("runner does not support gathering facts")
+	}
+	output, err := p.probe(factsScript, nil)
+	if err != nil {
+		return nil, err
+	}
+	facts, err := parseFacts(output)
+	if err != nil {
+		return nil, err
+	}
+	factsCache.Store(runner, facts)
+	return facts, nil
+}
+
+func parseFacts(output []byte) (*Facts, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	values := make(map[string]string)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "---" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[key] = strings.TrimSpace(value)
+		}
+	}
+	if values["os"] == "" {
+		return nil, fmt.Errorf("unexpected output while gathering facts: %q", output)
+	}
+	osRelease := parseOSRelease(scanner)
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	facts := &Facts{
+		Hostname:       values["hostname"],
+		OS:             strings.ToLower(values["os"]),
+		Kernel:         values["kernel"],
+		Machine:        values["machine"],
+		PackageManager: strings.TrimSuffix(values["package_manager"], "-get"),
+		InitSystem:     values["init_system"],
+		Container:      values["container"],
+		Firewall:       values["firewall"],
+		Distro: Distro{
+			ID:         osRelease["ID"],
+			Name:       osRelease["NAME"],
+			Version:    osRelease["VERSION_ID"],
+			PrettyName: osRelease["PRETTY_NAME"],
+			IDLike:     strings.Fields(osRelease["ID_LIKE"]),
+		},
+	}
+	facts.Architecture, facts.Variant = normalizeArch(facts.Machine)
+	facts.IsContainer = facts.Container != ""
+	facts.CPUs, _ = strconv.Atoi(values["cpus"])
+	if memoryKB, err := strconv.ParseInt(values["memory_kb"], 10, 64); err == nil {
+		facts.MemoryMB = memoryKB / 1024
+	}
+	return facts, nil
+}
+
+// parseOSRelease reads KEY=value lines in the os-release format
+func parseOSRelease(scanner *bufio.Scanner) map[string]string {
+	values := make(map[string]string)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := processWord(value, nil, DefaultEscapeToken); err == nil {
+			value = unquoted
+		}
+		values[key] = value
+	}
+	return values
+}
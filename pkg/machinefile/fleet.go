@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSkipped is reported for targets that were not run because an earlier
+// batch exceeded the failure threshold
+var ErrSkipped = errors.New("skipped")
+
+// FleetTarget is a named runner that takes part in a multi-host run
+type FleetTarget struct {
+	Name   string
+	Runner Runner
+	Args   map[string]string // ARG values for this target
+}
+
+// FleetResult is the outcome of running a Dockerfile on a single target
+type FleetResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// FleetStrategy controls how a run is rolled out over the targets
+type FleetStrategy struct {
+	Forks             int    // Number of targets to run in parallel
+	Serial            string // Batch size, either a number or a percentage like "25%"; empty runs all targets in one batch
+	MaxFailPercentage int    // Halt when more than this percentage of a batch fails; negative disables the check
+	StopOnFailure     bool   // Halt as soon as any target fails
+}
+
+// BatchSize returns the number of targets per batch for the given total
+func (fs FleetStrategy) BatchSize(total int) (int, error) {
+	serial := strings.TrimSpace(fs.Serial)
+	if serial == "" || total == 0 {
+		return total, nil
+	}
+
+	var size int
+	if strings.HasSuffix(serial, "%") {
+		percentage, err := strconv.Atoi(strings.TrimSuffix(serial, "%"))
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return 0, fmt.Errorf("invalid serial percentage: %s", serial)
+		}
+		size = total * percentage / 100
+	} else {
+		n, err := strconv.Atoi(serial)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid serial batch size: %s", serial)
+		}
+		size = n
+	}
+
+	if size < 1 {
+		size = 1
+	}
+	if size > total {
+		size = total
+	}
+	return size, nil
+}
+
+// RunFleet runs a Dockerfile on all targets in batches as described by the
+// strategy. When a batch exceeds the failure threshold, the remaining targets
+// are reported as skipped. Results are returned in the order of targets.
+func RunFleet(dockerfilePath string, targets []FleetTarget, strategy FleetStrategy, options Options) ([]FleetResult, error) {
+	batchSize, err := strategy.BatchSize(len(targets))
+	if err != nil {
+		return nil, err
+	}
+	forks := strategy.Forks
+	if forks < 1 {
+		forks = 1
+	}
+
+	results := make([]FleetResult, len(targets))
+	for i, target := range targets {
+		results[i] = FleetResult{Name: target.Name, Err: ErrSkipped}
+	}
+
+	var halted atomic.Bool
+	for start := 0; start < len(targets) && !halted.Load(); start += batchSize {
+		end := start + batchSize
+		if end > len(targets) {
+			end = len(targets)
+		}
+		if batchSize < len(targets) {
+			fmt.Printf("Running batch %d-%d of %d hosts\n", start+1, end, len(targets))
+		}
+
+		slots := make(chan struct{}, forks)
+		var wg sync.WaitGroup
+		var failed atomic.Int32
+		for i := start; i < end; i++ {
+			slots <- struct{}{}
+			if halted.Load() {
+				<-slots
+				break
+			}
+			wg.Add(1)
+			go func(i int, target FleetTarget) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				began := time.Now()
+				err := ParseAndRunDockerfile(dockerfilePath, target.Runner, target.Args, options)
+				if err != nil {
+					fmt.Fprintf(runnerStderr(target.Runner), "Error running Dockerfile: %v\n", err)
+					failed.Add(1)
+					if strategy.StopOnFailure {
+						halted.Store(true)
+					}
+				}
+				flushRunnerOutput(target.Runner)
+
+				results[i] = FleetResult{Name: target.Name, Err: err, Duration: time.Since(began)}
+			}(i, targets[i])
+		}
+		wg.Wait()
+
+		if strategy.MaxFailPercentage >= 0 && int(failed.Load())*100 > strategy.MaxFailPercentage*(end-start) {
+			fmt.Printf("Failure threshold exceeded: %d of %d hosts in batch failed (max %d%%)\n", failed.Load(), end-start, strategy.MaxFailPercentage)
+			halted.Store(true)
+		}
+	}
+	if halted.Load() {
+		fmt.Printf("Halting run, remaining hosts are skipped\n")
+	}
+
+	return results, nil
+}
+
+// flushRunnerOutput writes out partial lines left in prefixed output
+func flushRunnerOutput(runner Runner) {
+	for _, w := range []io.Writer{runnerStdout(runner), runnerStderr(runner)} {
+		if pw, ok := w.(*PrefixWriter); ok {
+			pw.Flush()
+		}
+	}
+}
+
+// PrintFleetSummary writes an overview of the results and returns the number
+// of targets that failed or were skipped
+func PrintFleetSummary(w io.Writer, results []FleetResult) int {
+	failed, skipped := 0, 0
+	fmt.Fprintf(w, "\nSummary:\n")
+	for _, result := range results {
+		status := "ok"
+		switch {
+		case errors.Is(result.Err, ErrSkipped):
+			status = "skipped"
+			skipped++
+		case result.Err != nil:
+			status = fmt.Sprintf("failed: %v", result.Err)
+			failed++
+		}
+		fmt.Fprintf(w, "  %-30s %s (%s)\n", result.Name, status, result.Duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "%d succeeded, %d failed, %d skipped\n", len(results)-failed-skipped, failed, skipped)
+	return failed + skipped
+}
@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// continuationIndent indents the continuation lines of an instruction
+const continuationIndent = "    "
+
+// Format parses a Dockerfile and returns it in canonical form: instruction
+// names in upper case, continuation lines indented with their escapes
+// aligned, and && chains in RUN spaced evenly with continuation lines
+// starting with &&. Text inside quotes is kept as written, including the
+// whitespace before an escape that continues a quoted string. Comments, the
+// shebang and parser directives are kept. Only whitespace outside of quotes
+// changes, which is verified by parsing the result again. Here-documents
+// can not be formatted, as their lines are not instructions.
+func Format(content []byte) ([]byte, error) {
+	df, err := ParseDockerfile(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range df.Instructions {
+		switch inst.Command {
+		case "RUN", "COPY", "ADD":
+			if heredocPattern.MatchString(inst.Args) {
+				return nil, fmt.Errorf("here-documents in %s on line %d can not be formatted", inst.Command, inst.Line)
+			}
+		}
+	}
+
+	formatted := []byte(df.Format())
+	check, err := ParseDockerfile(bytes.NewReader(formatted))
+	if err != nil {
+		return nil, fmt.Errorf("formatted file can not be parsed: %w", err)
+	}
+	if err := compareDockerfiles(df, check); err != nil {
+		return nil, fmt.Errorf("formatting changed the file: %w", err)
+	}
+	return formatted, nil
+}
+
+// Format writes the Dockerfile in canonical form
+func (df *Dockerfile) Format() string {
+	var out strings.Builder
+	for _, line := range df.Header {
+		out.WriteString(line + "\n")
+	}
+
+	// Keep single empty lines between blocks, but none at the start or end
+	blank := false
+	writeComments := func(comments []string) {
+		for _, comment := range comments {
+			if comment == "" {
+				blank = true
+				continue
+			}
+			if blank && out.Len() > 0 {
+				out.WriteString("\n")
+			}
+			blank = false
+			out.WriteString(comment + "\n")
+		}
+	}
+
+	for _, inst := range df.Instructions {
+		writeComments(inst.Comments)
+		if blank && out.Len() > 0 {
+			out.WriteString("\n")
+		}
+		blank = false
+		out.WriteString(inst.format(df.EscapeToken))
+	}
+	writeComments(df.Trailing)
+	return out.String()
+}
+
+// format writes an instruction with its continuation lines
+func (inst *Instruction) format(escapeToken rune) string {
+	lines := inst.Lines
+	if len(lines) == 0 {
+		lines = []string{inst.Args}
+	}
+	if inst.Command == "RUN" && !strings.HasPrefix(inst.Args, "[") {
+		lines = normalizeChains(lines, escapeToken)
+	}
+	quoted := quotedLineEnds(lines, escapeToken)
+
+	// Only instruction names are changed to upper case
+	command := inst.Command
+	if !dockerfileInstructions[command] {
+		command = inst.rawCommand()
+	}
+
+	formatted := make([]string, len(lines))
+	for i, line := range lines {
+		if !quoted[i] {
+			line = strings.TrimRight(line, " \t")
+		}
+		switch {
+		case i == 0 && line == "":
+			formatted[i] = command
+		case i == 0:
+			formatted[i] = command + " " + line
+		default:
+			formatted[i] = continuationIndent + line
+		}
+	}
+
+	// Align the escapes of all lines continuing the instruction, which
+	// excludes comment lines and the last line. Lines ending inside quotes
+	// keep their escape right after the text, as the whitespace before it
+	// is part of the value.
+	continued := func(i int) bool {
+		return i < len(lines)-1 && !(i > 0 && strings.HasPrefix(lines[i], "#"))
+	}
+	width := 0
+	for i, line := range formatted {
+		if continued(i) && !quoted[i] && utf8.RuneCountInString(line) > width {
+			width = utf8.RuneCountInString(line)
+		}
+	}
+
+	var out strings.Builder
+	for i, line := range formatted {
+		out.WriteString(line)
+		if continued(i) {
+			if !quoted[i] {
+				out.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(line)) + " ")
+			}
+			out.WriteRune(escapeToken)
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// dockerfileInstructions are the instruction names of the Dockerfile format
+var dockerfileInstructions = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true,
+	"ENV": true, "EXPOSE": true, "FROM": true, "HEALTHCHECK": true,
+	"LABEL": true, "MAINTAINER": true, "ONBUILD": true, "RUN": true,
+	"SHELL": true, "STOPSIGNAL": true, "USER": true, "VOLUME": true,
+	"WORKDIR": true,
+}
+
+// rawCommand returns the instruction name as written
+func (inst *Instruction) rawCommand() string {
+	line, _, _ := strings.Cut(inst.Original, "\n")
+	line = strings.TrimSpace(line)
+	if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// quotedLineEnds reports for each line of an instruction whether it ends
+// inside quotes. Comment lines are skipped, and an escape at the end of a
+// line continues the instruction, so it does not escape anything.
+func quotedLineEnds(lines []string, escapeToken rune) []bool {
+	quoted := make([]bool, len(lines))
+	var quote rune
+	for i, line := range lines {
+		if i > 0 && strings.HasPrefix(line, "#") {
+			continue
+		}
+		escaped := false
+		for _, ch := range line {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == escapeToken && quote != '\'':
+				escaped = true
+			case quote != 0:
+				if ch == quote {
+					quote = 0
+				}
+			case ch == '\'' || ch == '"':
+				quote = ch
+			}
+		}
+		quoted[i] = quote != 0
+	}
+	return quoted
+}
+
+// normalizeChains spaces && evenly outside of quotes and moves a && ending a
+// line to the start of the next line. Text inside quotes is not changed.
+func normalizeChains(lines []string, escapeToken rune) []string {
+	result := make([]string, len(lines))
+	var quote rune
+	carry := false
+	for i, line := range lines {
+		if i > 0 && strings.HasPrefix(line, "#") {
+			result[i] = line
+			continue
+		}
+
+		var out strings.Builder
+		if carry {
+			out.WriteString("&& ")
+			carry = false
+		}
+		runes := []rune(line)
+		escaped := false
+		for j := 0; j < len(runes); j++ {
+			ch := runes[j]
+			switch {
+			case escaped:
+				escaped = false
+			case ch == escapeToken && quote != '\'':
+				escaped = true
+			case quote != 0:
+				if ch == quote {
+					quote = 0
+				}
+			case ch == '\'' || ch == '"':
+				quote = ch
+			case ch == '&' && j+1 < len(runes) && runes[j+1] == '&':
+				j++
+				rest := strings.TrimSpace(string(runes[j+1:]))
+				trimmed := strings.TrimRight(out.String(), " \t")
+				out.Reset()
+				out.WriteString(trimmed)
+				if rest == "" && i < len(lines)-1 {
+					carry = true
+					j = len(runes)
+					continue
+				}
+				if trimmed != "" {
+					out.WriteString(" ")
+				}
+				out.WriteString("&& ")
+				for j+1 < len(runes) && (runes[j+1] == ' ' || runes[j+1] == '\t') {
+					j++
+				}
+				continue
+			}
+			out.WriteRune(ch)
+		}
+		result[i] = out.String()
+		if quote == 0 {
+			result[i] = strings.TrimRight(result[i], " \t")
+		}
+	}
+	return result
+}
+
+// argWords splits arguments into words at whitespace outside of quotes, with
+// && as a word of its own, so arguments that only differ in that whitespace
+// have the same words
+func argWords(args string, escapeToken rune) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	escaped := false
+	runes := []rune(args)
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	for j := 0; j < len(runes); j++ {
+		ch := runes[j]
+		switch {
+		case escaped:
+			escaped = false
+		case ch == escapeToken && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ' ' || ch == '\t':
+			flush()
+			continue
+		case ch == '&' && j+1 < len(runes) && runes[j+1] == '&':
+			flush()
+			words = append(words, "&&")
+			j++
+			continue
+		}
+		word.WriteRune(ch)
+	}
+	flush()
+	return words
+}
+
+// compareDockerfiles reports the first instruction that differs between two
+// parses of a file in more than whitespace outside of quotes and the case of
+// instruction names
+func compareDockerfiles(a, b *Dockerfile) error {
+	if a.EscapeToken != b.EscapeToken || a.Syntax != b.Syntax || len(a.Header) != len(b.Header) {
+		return fmt.Errorf("parser directives differ")
+	}
+	if len(a.Instructions) != len(b.Instructions) {
+		return fmt.Errorf("number of instructions differs: %d and %d", len(a.Instructions), len(b.Instructions))
+	}
+	for i, inst := range a.Instructions {
+		other := b.Instructions[i]
+		sameCommand := inst.rawCommand() == other.rawCommand() ||
+			(dockerfileInstructions[inst.Command] && inst.Command == other.Command)
+		if !sameCommand || inst.When != other.When ||
+			strings.Join(argWords(inst.Args, a.EscapeToken), "\n") != strings.Join(argWords(other.Args, b.EscapeToken), "\n") ||
+			strings.Join(continuationComments(inst), "\n") != strings.Join(continuationComments(other), "\n") ||
+			strings.Join(nonEmpty(inst.Comments), "\n") != strings.Join(nonEmpty(other.Comments), "\n") {
+			return fmt.Errorf("%s on line %d differs", inst.rawCommand(), inst.Line)
+		}
+	}
+	if strings.Join(nonEmpty(a.Trailing), "\n") != strings.Join(nonEmpty(b.Trailing), "\n") {
+		return fmt.Errorf("trailing comments differ")
+	}
+	return nil
+}
+
+// continuationComments returns the comment lines between the continuation
+// lines of an instruction
+func continuationComments(inst *Instruction) []string {
+	var comments []string
+	for i, line := range inst.Lines {
+		if i > 0 && strings.HasPrefix(line, "#") {
+			comments = append(comments, line)
+		}
+	}
+	return comments
+}
+
+// nonEmpty returns the lines that are not empty
+func nonEmpty(lines []string) []string {
+	var result []string
+	for _, line := range lines {
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
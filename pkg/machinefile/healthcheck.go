@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// healthcheck is a HEALTHCHECK instruction with the defaults Docker uses
+type healthcheck struct {
+	Command     execCommand
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+}
+
+// parseHealthcheck parses the arguments of HEALTHCHECK, returning nil for
+// HEALTHCHECK NONE
+func parseHealthcheck(args string) (*healthcheck, error) {
+	check := &healthcheck{
+		Interval: 30 * time.Second,
+		Timeout:  30 * time.Second,
+		Retries:  3,
+	}
+
+	rest := strings.TrimSpace(args)
+	for strings.HasPrefix(rest, "--") {
+		option, remaining, _ := strings.Cut(rest, " ")
+		rest = strings.TrimSpace(remaining)
+
+		name, value, ok := strings.Cut(strings.TrimPrefix(option, "--"), "=")
+		if !ok {
+			return nil, fmt.Errorf("HEALTHCHECK option %s requires a value", option)
+		}
+		var err error
+		switch name {
+		case "interval":
+			check.Interval, err = time.ParseDuration(value)
+		case "timeout":
+			check.Timeout, err = time.ParseDuration(value)
+		case "start-period":
+			check.StartPeriod, err = time.ParseDuration(value)
+		case "start-interval":
+			// Only used by container engines during the start period
+			_, err = time.ParseDuration(value)
+		case "retries":
+			_, err = fmt.Sscanf(value, "%d", &check.Retries)
+		default:
+			return nil, fmt.Errorf("unknown HEALTHCHECK option %s", option)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid HEALTHCHECK option %s: %w", option, err)
+		}
+	}
+
+	kind, command, _ := strings.Cut(rest, " ")
+	switch strings.ToUpper(kind) {
+	case "NONE":
+		return nil, nil
+	case "CMD":
+		command = strings.TrimSpace(command)
+		if command == "" {
+			return nil, fmt.Errorf("HEALTHCHECK CMD requires a command")
+		}
+		check.Command = parseExecCommand(command)
+	default:
+		return nil, fmt.Errorf("HEALTHCHECK must be followed by CMD or NONE")
+	}
+	if check.Retries < 1 {
+		return nil, fmt.Errorf("HEALTHCHECK retries must be at least 1")
+	}
+	return check, nil
+}
+
+// script returns the check as a shell command that is killed after the
+// timeout
+func (hc *healthcheck) script() string {
+	command := hc.Command.Args[0]
+	if !hc.Command.Shell {
+		command = shellJoin(hc.Command.Args)
+	}
+	seconds := int(math.Ceil(hc.Timeout.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return fmt.Sprintf("timeout %d sh -c %s", seconds, shellQuote(command))
+}
+
+// verifyHealth runs the check through the runner after all instructions ran,
+// right away and then every interval. Failures during the start period are
+// not counted, and the target is unhealthy after retries failures in a row.
+func verifyHealth(runner Runner, hc *healthcheck, userName string, envVars map[string]string) error {
+	out := runnerStdout(runner)
+	if _, ok := runner.(*DryRunner); ok {
+		fmt.Fprintf(out, "Would verify health every %s with: %s\n", hc.Interval, hc.script())
+		return nil
+	}
+
+	fmt.Fprintf(out, "Verifying health (interval %s, timeout %s, start period %s, retries %d)\n", hc.Interval, hc.Timeout, hc.StartPeriod, hc.Retries)
+	started := time.Now()
+	failures := 0
+	for attempt := 1; ; attempt++ {
+		err := runner.RunCommand(hc.script(), userName, envVars)
+		if err == nil {
+			fmt.Fprintf(out, "Health check passed on attempt %d\n", attempt)
+			return nil
+		}
+		if time.Since(started) < hc.StartPeriod {
+			fmt.Fprintf(out, "Health check failed during start period: %v\n", err)
+		} else {
+			failures++
+			fmt.Fprintf(out, "Health check failed (%d of %d): %v\n", failures, hc.Retries, err)
+			if failures >= hc.Retries {
+				return fmt.Errorf("target is unhealthy after %d failed health checks", failures)
+			}
+		}
+		time.Sleep(hc.Interval)
+	}
+}
+
+// healthcheckUnits returns a oneshot service running the check and a timer
+// that starts it every interval, installed next to the service name
+func healthcheckUnits(name string, hc *healthcheck, st *stage) (string, string, error) {
+	var service strings.Builder
+	service.WriteString("[Unit]\n")
+	fmt.Fprintf(&service, "Description=Health check of %s\n", name)
+	fmt.Fprintf(&service, "After=%s.service\n", name)
+	service.WriteString("\n[Service]\n")
+	service.WriteString("Type=oneshot\n")
+	fmt.Fprintf(&service, "ExecStart=/bin/sh -c %s\n", systemdQuote(hc.script(), true))
+	if err := writeServiceContext(&service, st); err != nil {
+		return "", "", err
+	}
+
+	var timer strings.Builder
+	timer.WriteString("[Unit]\n")
+	fmt.Fprintf(&timer, "Description=Periodic health check of %s\n", name)
+	timer.WriteString("\n[Timer]\n")
+	// OnUnitActiveSec=0 would never fire again, so the interval is at least 1s
+	fmt.Fprintf(&timer, "OnActiveSec=%d\n", int(math.Ceil(hc.StartPeriod.Seconds())))
+	fmt.Fprintf(&timer, "OnUnitActiveSec=%d\n", shellSeconds(hc.Interval))
+	timer.WriteString("\n[Install]\n")
+	timer.WriteString("WantedBy=timers.target\n")
+	return service.String(), timer.String(), nil
+}
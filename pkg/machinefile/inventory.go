@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// InventoryHost is a single machine from an inventory file
+type InventoryHost struct {
+	Name   string
+	Groups []string
+	Vars   map[string]string
+}
+
+// Inventory is a set of hosts organised in groups, read from an INI file:
+//
+//	[web]
+//	web1.example.com user=root port=2222
+//	web2 host=10.0.0.12 arg.VERSION=2.0
+//
+//	[web:vars]
+//	key=~/.ssh/id_web
+//
+//	[prod:children]
+//	web
+//
+// Supported host variables are host, user, port, key, cert, password and jump.
+// Variables prefixed with "arg." override ARG values for that host. Host
+// variables take precedence over group variables, which take precedence over
+// [all:vars].
+type Inventory struct {
+	Hosts    []*InventoryHost
+	groups   map[string][]string // group name to host names
+	children map[string][]string // group name to child group names
+	vars     map[string]map[string]string
+}
+
+// inventoryVarAliases maps Ansible style variable names onto ours
+var inventoryVarAliases = map[string]string{
+	"ansible_host":                 "host",
+	"ansible_user":                 "user",
+	"ansible_port":                 "port",
+	"ansible_ssh_private_key_file": "key",
+	"ansible_password":             "password",
+}
+
+func LoadInventory(inventoryPath string) (*Inventory, error) {
+	file, err := os.Open(inventoryPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening inventory: %w", err)
+	}
+	defer file.Close()
+
+	inv := &Inventory{
+		groups:   make(map[string][]string),
+		children: make(map[string][]string),
+		vars:     make(map[string]map[string]string),
+	}
+	hosts := make(map[string]*InventoryHost)
+
+	section := "ungrouped"
+	kind := "hosts"
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			kind = "hosts"
+			if name, suffix, ok := strings.Cut(section, ":"); ok {
+				if suffix != "vars" && suffix != "children" {
+					return nil, fmt.Errorf("inventory line %d: unknown section type %q", lineNumber, suffix)
+				}
+				section, kind = name, suffix
+			}
+			if _, exists := inv.groups[section]; !exists {
+				inv.groups[section] = nil
+			}
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("inventory line %d: expected KEY=VALUE, got %s", lineNumber, line)
+			}
+			if inv.vars[section] == nil {
+				inv.vars[section] = make(map[string]string)
+			}
+			inv.vars[section][normalizeInventoryVar(key)] = strings.Trim(strings.TrimSpace(value), "\"'")
+
+		case "children":
+			inv.children[section] = append(inv.children[section], line)
+
+		default:
+			fields := strings.Fields(line)
+			host, exists := hosts[fields[0]]
+			if !exists {
+				host = &InventoryHost{Name: fields[0], Vars: make(map[string]string)}
+				hosts[fields[0]] = host
+				inv.Hosts = append(inv.Hosts, host)
+			}
+			for _, field := range fields[1:] {
+				key, value, ok := strings.Cut(field, "=")
+				if !ok {
+					return nil, fmt.Errorf("inventory line %d: expected KEY=VALUE, got %s", lineNumber, field)
+				}
+				host.Vars[normalizeInventoryVar(key)] = strings.Trim(value, "\"'")
+			}
+			inv.groups[section] = append(inv.groups[section], host.Name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading inventory: %w", err)
+	}
+
+	for _, host := range inv.Hosts {
+		host.Groups = inv.groupsOf(host.Name)
+		host.Vars = inv.resolveVars(host)
+	}
+	return inv, nil
+}
+
+func normalizeInventoryVar(key string) string {
+	key = strings.TrimSpace(key)
+	if alias, ok := inventoryVarAliases[key]; ok {
+		return alias
+	}
+	return key
+}
+
+// groupsOf returns all groups a host belongs to, including parent groups
+func (inv *Inventory) groupsOf(hostName string) []string {
+	var groups []string
+	for group := range inv.groups {
+		if inv.groupContains(group, hostName, map[string]bool{}) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func (inv *Inventory) groupContains(group, hostName string, seen map[string]bool) bool {
+	if seen[group] {
+		return false
+	}
+	seen[group] = true
+	for _, name := range inv.groups[group] {
+		if name == hostName {
+			return true
+		}
+	}
+	for _, child := range inv.children[group] {
+		if inv.groupContains(child, hostName, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveVars merges [all:vars], group vars and host vars
+func (inv *Inventory) resolveVars(host *InventoryHost) map[string]string {
+	vars := make(map[string]string)
+	for k, v := range inv.vars["all"] {
+		vars[k] = v
+	}
+	for _, group := range host.Groups {
+		for k, v := range inv.vars[group] {
+			vars[k] = v
+		}
+	}
+	for k, v := range host.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// Limit returns the hosts matching a comma separated list of host names, group
+// names or glob patterns. A pattern prefixed with "!" excludes matching hosts.
+// An empty limit selects all hosts.
+func (inv *Inventory) Limit(limit string) ([]*InventoryHost, error) {
+	if strings.TrimSpace(limit) == "" {
+		return inv.Hosts, nil
+	}
+
+	var include, exclude []string
+	for _, pattern := range strings.Split(limit, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "!") {
+			exclude = append(exclude, pattern[1:])
+		} else {
+			include = append(include, pattern)
+		}
+	}
+	if len(include) == 0 {
+		include = []string{"all"}
+	}
+
+	var selected []*InventoryHost
+	for _, host := range inv.Hosts {
+		if inv.hostMatches(host, include) && !inv.hostMatches(host, exclude) {
+			selected = append(selected, host)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no hosts matched limit %q", limit)
+	}
+	return selected, nil
+}
+
+func (inv *Inventory) hostMatches(host *InventoryHost, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "all" || pattern == "*" {
+			return true
+		}
+		if ok, _ := path.Match(pattern, host.Name); ok {
+			return true
+		}
+		for _, group := range host.Groups {
+			if ok, _ := path.Match(pattern, group); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Address returns the address to connect to for the host
+func (h *InventoryHost) Address() string {
+	if address := h.Vars["host"]; address != "" {
+		return address
+	}
+	return h.Name
+}
+
+// Args returns the ARG overrides set for the host
+func (h *InventoryHost) Args() map[string]string {
+	args := make(map[string]string)
+	for k, v := range h.Vars {
+		if strings.HasPrefix(k, "arg.") {
+			args[strings.TrimPrefix(k, "arg.")] = v
+		}
+	}
+	return args
+}
+
+// SSHRunner creates a runner for the host, using the values of defaults for
+// settings the inventory does not provide
+func (h *InventoryHost) SSHRunner(defaults SSHRunner) *SSHRunner {
+	runner := defaults
+	runner.SshHost = h.Address()
+	if user := h.Vars["user"]; user != "" {
+		runner.SshUser = user
+	}
+	if port := h.Vars["port"]; port != "" {
+		runner.SshPort = port
+	}
+	if key := h.Vars["key"]; key != "" {
+		runner.SshKeyPath = expandHome(key)
+	}
+	if password := h.Vars["password"]; password != "" {
+		runner.SshPassword = password
+	}
+	if jump := h.Vars["jump"]; jump != "" {
+		runner.SshJump = jump
+	}
+	if cert := h.Vars["cert"]; cert != "" {
+		runner.SshCertPath = expandHome(cert)
+	}
+	return &runner
+}
+
+// expandHome replaces a leading ~ with the home directory of the current user
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + p[1:]
+		}
+	}
+	return p
+}
@@ -0,0 +1,393 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Severities of lint findings
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// LintRule describes a check of the linter
+type LintRule struct {
+	ID          string
+	Severity    string
+	Description string
+}
+
+// LintRules lists the checks of the linter, which can be skipped with the
+// check parser directive
+var LintRules = []LintRule{
+	{"ParseError", SeverityError, "The file can not be parsed"},
+	{"UnsupportedInstruction", SeverityWarning, "Instruction is not supported by machinefile and is ignored"},
+	{"UnsupportedFeature", SeverityWarning, "Feature of newer Dockerfile syntax is not supported by machinefile"},
+	{"UndefinedVar", SeverityWarning, "Variable is used but not declared with ARG or ENV"},
+	{"UndefinedArgInUser", SeverityError, "USER references an ARG that is not declared"},
+	{"CopySourceNotFound", SeverityError, "Source of COPY or ADD does not exist in the context"},
+	{"AptGetWithoutYes", SeverityWarning, "apt-get needs -y to run without prompting"},
+	{"CdInRun", SeverityWarning, "cd in RUN only applies to that step, WORKDIR applies to later steps"},
+	{"MissingSetE", SeverityWarning, "RUN with several commands ignores failures without set -e"},
+	{"MachineDifference", SeverityInfo, "Instruction behaves differently on a machine than in a container"},
+}
+
+// LintFinding is a problem found by the linter
+type LintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// supportedInstructions are the instructions machinefile acts on
+var supportedInstructions = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "USER": true,
+	"ENV": true, "ARG": true, "WORKDIR": true, "ENTRYPOINT": true, "CMD": true,
+	"HEALTHCHECK": true, "EXPOSE": true, "VOLUME": true, "LABEL": true,
+	"STOPSIGNAL": true,
+}
+
+// machineDifferences explains instructions that behave differently on a
+// machine than in a container
+var machineDifferences = map[string]string{
+	"FROM":        "FROM does not pull an image, steps run on the target as it is",
+	"ENTRYPOINT":  "ENTRYPOINT is only used with --install-service, which runs it as a systemd service",
+	"CMD":         "CMD is only used with --install-service, which runs it as a systemd service",
+	"EXPOSE":      "EXPOSE only opens ports in the firewall with --apply-expose",
+	"VOLUME":      "VOLUME creates the directory on the target, no volume is mounted",
+	"HEALTHCHECK": "HEALTHCHECK is run once after all steps instead of continuously, and with ENTRYPOINT or CMD only with --install-service",
+	"ENV":         "ENV applies to later steps and an installed service, not to the environment of the machine",
+}
+
+// variablePattern matches variable references like $NAME and ${NAME:-x}
+var variablePattern = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// LintFile checks the Dockerfile at path without running anything. COPY
+// sources are looked up in contextDir. Checks skipped by the check directive
+// are left out.
+func LintFile(path, contextDir string) ([]LintFinding, *Dockerfile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening Dockerfile: %w", err)
+	}
+	df, err := ParseDockerfile(bytes.NewReader(content))
+	if err != nil {
+		return []LintFinding{{Rule: "ParseError", Severity: SeverityError, Message: err.Error(), File: path, Line: 1}}, nil, nil
+	}
+
+	l := &linter{file: path, contextDir: contextDir, df: df}
+	l.run()
+
+	skip := make(map[string]bool)
+	for _, rule := range df.CheckSkip {
+		skip[strings.ToLower(rule)] = true
+	}
+	var findings []LintFinding
+	for _, finding := range l.findings {
+		if !skip["all"] && !skip[strings.ToLower(finding.Rule)] {
+			findings = append(findings, finding)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Line < findings[j].Line })
+	return findings, df, nil
+}
+
+type linter struct {
+	file       string
+	contextDir string
+	df         *Dockerfile
+	findings   []LintFinding
+}
+
+func (l *linter) report(rule string, line int, format string, args ...interface{}) {
+	severity := SeverityWarning
+	for _, r := range LintRules {
+		if r.ID == rule {
+			severity = r.Severity
+		}
+	}
+	l.findings = append(l.findings, LintFinding{
+		Rule:     rule,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		File:     l.file,
+		Line:     line,
+	})
+}
+
+func (l *linter) run() {
+	l.checkVariables()
+	reported := make(map[string]bool)
+	for _, inst := range l.df.Instructions {
+		if !supportedInstructions[inst.Command] {
+			l.report("UnsupportedInstruction", inst.Line, "%s is not supported and will be ignored", inst.Command)
+			continue
+		}
+		for _, feature := range inst.unsupportedFeatures() {
+			l.report("UnsupportedFeature", inst.Line, "%s is not supported", feature)
+		}
+		if difference, ok := machineDifferences[inst.Command]; ok && !reported[inst.Command] {
+			reported[inst.Command] = true
+			l.report("MachineDifference", inst.Line, "%s", difference)
+		}
+
+		switch inst.Command {
+		case "RUN":
+			l.checkRun(inst)
+		case "COPY", "ADD":
+			l.checkCopySources(inst)
+		}
+	}
+}
+
+// checkVariables reports variables used outside RUN, CMD, ENTRYPOINT and
+// HEALTHCHECK that are not in scope, following the ARG scoping rules of the
+// executor. Those instructions are expanded by the shell of the step.
+func (l *linter) checkVariables() {
+	global := make(map[string]bool)
+	for name := range builtinArgs {
+		global[name] = true
+	}
+	stageEnv := make(map[string]map[string]bool)
+
+	var scope map[string]bool
+	if !hasFrom(l.df.Instructions) {
+		scope = make(map[string]bool)
+	}
+	for _, inst := range l.df.Instructions {
+		switch {
+		case inst.Command == "FROM":
+			l.checkUndefined(inst, inst.Args, global)
+			words := strings.Fields(inst.Args)
+			scope = make(map[string]bool)
+			if len(words) > 0 {
+				for name := range stageEnv[strings.ToLower(words[0])] {
+					scope[name] = true
+				}
+			}
+			if len(words) == 3 && strings.EqualFold(words[1], "AS") {
+				stageEnv[strings.ToLower(words[2])] = scope
+			}
+			continue
+		case scope == nil:
+			// Global ARGs before the first FROM
+			if inst.Command == "ARG" {
+				l.declare(inst, global, global)
+			}
+			continue
+		case inst.Command == "RUN" || inst.Command == "CMD" || inst.Command == "ENTRYPOINT" || inst.Command == "HEALTHCHECK":
+			continue
+		}
+
+		switch inst.Command {
+		case "ARG":
+			l.declare(inst, scope, scope)
+		case "ENV":
+			assignments, err := parseAssignments("ENV", inst.Args, nil, l.df.EscapeToken, true)
+			if err == nil {
+				for _, env := range assignments {
+					scope[env.Key] = true
+				}
+			}
+			l.checkUndefined(inst, inst.Args, scope)
+		case "USER":
+			for _, match := range variablePattern.FindAllStringSubmatch(inst.Args, -1) {
+				if !scope[match[1]] {
+					l.report("UndefinedArgInUser", inst.Line, "USER references %s, which is not declared with ARG or ENV in this stage", match[1])
+				}
+			}
+		default:
+			l.checkUndefined(inst, inst.Args, scope)
+		}
+	}
+}
+
+// declare adds the ARGs of an instruction to scope, checking their defaults
+// against vars
+func (l *linter) declare(inst *Instruction, scope, vars map[string]bool) {
+	for _, word := range splitWords(inst.Args, l.df.EscapeToken) {
+		name, value, _ := strings.Cut(word, "=")
+		l.checkUndefined(inst, value, vars)
+		scope[name] = true
+	}
+}
+
+func (l *linter) checkUndefined(inst *Instruction, text string, scope map[string]bool) {
+	for _, match := range variablePattern.FindAllStringSubmatchIndex(text, -1) {
+		if match[0] > 0 && rune(text[match[0]-1]) == l.df.EscapeToken {
+			continue
+		}
+		name := text[match[2]:match[3]]
+		if !scope[name] {
+			l.report("UndefinedVar", inst.Line, "%s uses %s, which is not declared with ARG or ENV in scope", inst.Command, name)
+		}
+	}
+}
+
+func (l *linter) checkRun(inst *Instruction) {
+	segments := shellSegments(inst.Args)
+	for _, segment := range segments {
+		fields := strings.Fields(segment)
+		for len(fields) > 0 && (strings.Contains(fields[0], "=") || fields[0] == "sudo") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "cd":
+			l.report("CdInRun", inst.Line, "cd only applies to this RUN step; use WORKDIR to change the directory of later steps")
+		case "apt-get", "apt":
+			if subcommand := aptSubcommand(fields[1:]); aptNeedsYes(subcommand) && !aptHasYes(fields[1:]) {
+				l.report("AptGetWithoutYes", inst.Line, "%s %s without -y will wait for confirmation", fields[0], subcommand)
+			}
+		}
+	}
+
+	if hasSequentialCommands(inst.Args) && !setsErrexit(inst.Args) {
+		l.report("MissingSetE", inst.Line, "RUN runs several commands separated by ; but a failing command does not stop it; add set -e")
+	}
+}
+
+// aptSubcommand returns the first argument of apt-get that is not an option
+// or the value of one
+func aptSubcommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" || arg == "-c" || arg == "-t":
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			return arg
+		}
+	}
+	return ""
+}
+
+func aptNeedsYes(subcommand string) bool {
+	switch subcommand {
+	case "install", "upgrade", "dist-upgrade", "full-upgrade", "remove", "purge", "autoremove", "build-dep":
+		return true
+	}
+	return false
+}
+
+func aptHasYes(args []string) bool {
+	for _, arg := range args {
+		if arg == "--yes" || arg == "--assume-yes" || strings.HasPrefix(arg, "-y") ||
+			(strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg, "y")) {
+			return true
+		}
+	}
+	return false
+}
+
+// setsErrexit reports whether a script enables exiting on errors
+func setsErrexit(script string) bool {
+	for _, segment := range shellSegments(script) {
+		fields := strings.Fields(segment)
+		if len(fields) < 2 || fields[0] != "set" {
+			continue
+		}
+		for i, arg := range fields[1:] {
+			if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg, "e") {
+				return true
+			}
+			if arg == "-o" && i+2 < len(fields) && fields[i+2] == "errexit" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shellSegments splits a script into simple commands on &&, ||, ;, | and
+// newlines outside of quotes
+func shellSegments(script string) []string {
+	var segments []string
+	var segment strings.Builder
+	var quote rune
+	escaped := false
+	for _, ch := range script {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ';' || ch == '&' || ch == '|' || ch == '\n':
+			segments = append(segments, segment.String())
+			segment.Reset()
+			continue
+		}
+		segment.WriteRune(ch)
+	}
+	return append(segments, segment.String())
+}
+
+// compoundKeywords follow a ; that ends the condition or body of a shell
+// compound command, like for x in a b; do ...; done
+var compoundKeywords = map[string]bool{
+	"do": true, "done": true, "then": true, "elif": true, "else": true,
+	"fi": true, "esac": true, "}": true,
+}
+
+// hasSequentialCommands reports whether a script has commands separated by
+// ; outside of quotes and compound command syntax
+func hasSequentialCommands(script string) bool {
+	var quote rune
+	escaped := false
+	runes := []rune(strings.TrimSpace(script))
+	for i, ch := range runes {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ';' && i+1 < len(runes) && runes[i+1] != ';' && (i == 0 || runes[i-1] != ';'):
+			next := strings.Fields(strings.NewReplacer(";", " ", "&", " ", "|", " ").Replace(string(runes[i+1:])))
+			if len(next) == 0 || !compoundKeywords[next[0]] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *linter) checkCopySources(inst *Instruction) {
+	words := splitWords(inst.Args, l.df.EscapeToken)
+	for len(words) > 0 && strings.HasPrefix(words[0], "--") {
+		words = words[1:]
+	}
+	if len(words) < 2 {
+		return
+	}
+	for _, source := range words[:len(words)-1] {
+		if strings.Contains(source, "$") || strings.Contains(source, "://") {
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(l.contextDir, source))
+		if err != nil || len(matches) == 0 {
+			l.report("CopySourceNotFound", inst.Line, "%s source %s does not exist in context %s", inst.Command, source, l.contextDir)
+		}
+	}
+}
@@ -1,38 +1,38 @@
 package internal
 
 import (
+	"io"
 	"os"
 	"fmt"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 )
 
 func (lr *LocalRunner) RunCommand(command string, userName string, envVars map[string]string) error {
-	expandedCommand := expandVariables(command, envVars)
-
-	var cmd *exec.Cmd
-
-	if userName != "" {
-		cmd = exec.Command("sudo", "-u", userName, "bash", "-c", expandedCommand)
-	} else {
-		cmd = exec.Command("bash", "-c", expandedCommand)
+	// Variables are exported by the script and expanded by the shell, as
+	// switching users drops cmd.Env
+	become := lr.become()
+	argv, interactive, err := become.command(userName, localUserName(), envExports(envVars)+workdirPrefix(lr.WorkDir)+command, nil)
+	if err != nil {
+		return err
 	}
+	cmd := exec.Command(argv[0], argv[1:]...)
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	cmd.Env = os.Environ()
-	for key, value := range envVars {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	fmt.Printf("Executing command: %s\n", command)
+	if interactive {
+		err = runWithPty(cmd, become.Password, os.Stdout)
+	} else {
+		err = become.run(cmd, argv)
 	}
-
-	fmt.Printf("Executing command: %s\n", expandedCommand)
-	err := cmd.Run()
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
-			fmt.Fprintf(os.Stderr, "Error running command: %s, Exit Code: %d\n", expandedCommand, exitError.ExitCode())
+			fmt.Fprintf(os.Stderr, "Error running command: %s, Exit Code: %d\n", command, exitError.ExitCode())
 		} else {
-			fmt.Fprintf(os.Stderr, "Error running command: %s, %v\n", expandedCommand, err)
+			fmt.Fprintf(os.Stderr, "Error running command: %s, %v\n", command, err)
 		}
 		return err
 	}
@@ -65,16 +65,15 @@ func (lr *LocalRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
 		var copyErr error
 		if srcInfo.IsDir() {
 			if isAdd {
-				os.MkdirAll(dest, 0755)
 				// Use cp -a to preserve permissions, ownership, timestamps, etc.
-				copyErr = exec.Command("bash", "-c", fmt.Sprintf("cp -a %s/* %s/", src, dest)).Run()
+				copyErr = lr.copyCommand(fmt.Sprintf("mkdir -p %s && cp -a %s/* %s/", shellQuote(dest), shellQuote(src), shellQuote(dest)))
 			} else {
 				// Use cp -a to preserve permissions, ownership, timestamps, etc.
-				copyErr = exec.Command("cp", "-a", src, dest).Run()
+				copyErr = lr.copyCommand(fmt.Sprintf("cp -a %s %s", shellQuote(src), shellQuote(dest)))
 			}
 		} else {
 			// Use cp -p to preserve permissions, ownership, timestamps
-			copyErr = exec.Command("cp", "-p", src, dest).Run()
+			copyErr = lr.copyCommand(fmt.Sprintf("cp -p %s %s", shellQuote(src), shellQuote(dest)))
 		}
 
 		if copyErr != nil {
@@ -90,3 +89,51 @@ func (lr *LocalRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
 	}
 	return nil
 }
+
+// copyCommand runs a copy as the user steps run as without USER, which is
+// root when become is enabled
+func (lr *LocalRunner) copyCommand(script string) error {
+	become := lr.become()
+	argv, interactive, err := become.command("", localUserName(), script, nil)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	if interactive {
+		return runWithPty(cmd, become.Password, os.Stdout)
+	}
+	return become.run(cmd, argv)
+}
+
+func (lr *LocalRunner) resolveUser(spec UserSpec) (*Identity, error) {
+	return resolveWithGetent(spec, func(database string, keys ...string) ([]byte, error) {
+		return exec.Command("getent", append([]string{database}, keys...)...).Output()
+	})
+}
+
+func (lr *LocalRunner) setWorkdir(dir string) {
+	lr.WorkDir = dir
+}
+
+func (lr *LocalRunner) become() *Become {
+	if lr.Become != nil {
+		return lr.Become
+	}
+	return defaultBecome
+}
+
+// localUserName returns the name of the user running machinefile
+func localUserName() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
+
+func (lr *LocalRunner) probe(script string, input io.Reader) ([]byte, error) {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Stdin = input
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
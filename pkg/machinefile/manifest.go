@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestPath is where the manifest of the last run is written on the target
+const ManifestPath = "/etc/machinefile/manifest.json"
+
+// Manifest records the configuration applied to a machine, so it can later
+// be asked what was applied
+type Manifest struct {
+	Source       string            `json:"source"`
+	SourceSHA256 string            `json:"source_sha256"`
+	AppliedAt    string            `json:"applied_at"`
+	Args         map[string]string `json:"args"`
+	Labels       map[string]string `json:"labels"`
+	Volumes      []string          `json:"volumes"`
+	ExposedPorts []string          `json:"exposed_ports"`
+	StopSignal   string            `json:"stop_signal,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Workdir      string            `json:"workdir,omitempty"`
+}
+
+// newManifest describes a run of the source with the final stage and the
+// ARGs that were used
+func newManifest(source string, content []byte, st *stage, args map[string]string) *Manifest {
+	sum := sha256.Sum256(content)
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		absSource = source
+	}
+	manifest := &Manifest{
+		Source:       absSource,
+		SourceSHA256: hex.EncodeToString(sum[:]),
+		AppliedAt:    time.Now().UTC().Format(time.RFC3339),
+		Args:         args,
+		Labels:       st.Labels,
+		Volumes:      append([]string{}, st.Volumes...),
+		StopSignal:   st.StopSignal,
+		User:         st.User,
+		Workdir:      st.Workdir,
+	}
+	manifest.ExposedPorts = []string{}
+	for _, port := range st.Expose {
+		manifest.ExposedPorts = append(manifest.ExposedPorts, port.String())
+	}
+	return manifest
+}
+
+// writeManifest writes the manifest to ManifestPath on the target through
+// the runner as the connecting user. The file is only readable by its owner,
+// as ARG values can hold secrets. For the same reason the content is passed
+// on stdin to a private temporary file first, so it is neither printed nor
+// put on a command line.
+func writeManifest(runner Runner, manifest *Manifest) error {
+	out := runnerStdout(runner)
+	if _, ok := runner.(*DryRunner); ok {
+		fmt.Fprintf(out, "Would write manifest to %s\n", ManifestPath)
+		return nil
+	}
+	p, ok := runner.(prober)
+	if !ok {
+		return fmt.Errorf("runner does not support writing files")
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Writing manifest to %s\n", ManifestPath)
+	temp, err := writeTempFile(p, append(content, '\n'))
+	if err != nil {
+		return err
+	}
+	path := shellQuote(ManifestPath)
+	script := fmt.Sprintf("mkdir -p %s && touch %s && chmod 600 %s && cat %s > %s; status=$?; rm -f %s; exit $status",
+		shellQuote(filepath.Dir(ManifestPath)), path, path, shellQuote(temp), path, shellQuote(temp))
+	return runner.RunCommand(script, "", nil)
+}
+
+// writeTempFile passes content on stdin to a temporary file on the target
+// that only the connecting user can read, and returns its path
+func writeTempFile(p prober, content []byte) (string, error) {
+	output, err := p.probe(`umask 077 && file=$(mktemp) && cat > "$file" && printf '%s' "$file"`, bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("error writing temporary file: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type NspawnRunner struct {
+	BaseDir      string
+	Directory    string // Rootfs directory passed to systemd-nspawn --directory
+	Machine      string // Image name passed to systemd-nspawn --machine
+	WorkDir      string // Working directory inside the container, set by WORKDIR
+	NspawnBinary string // Path to systemd-nspawn binary
+}
+
+func (nr *NspawnRunner) RunCommand(command string, userName string, envVars map[string]string) error {
+	nspawnArgs := nr.containerArgs()
+	var setpriv []string
+	if userName != "" {
+		spec, err := ParseUserSpec(userName)
+		if err != nil {
+			return err
+		}
+		identity, err := nr.resolveUser(spec)
+		if err != nil {
+			return err
+		}
+		if spec.Group == "" && identity.Name != "" {
+			nspawnArgs = append(nspawnArgs, "--user="+identity.Name)
+		} else {
+			// systemd-nspawn can only switch to named users, so use setpriv
+			// inside the container for groups and ids without an entry
+			setpriv = []string{
+				"setpriv",
+				fmt.Sprintf("--reuid=%d", identity.Uid),
+				fmt.Sprintf("--regid=%d", identity.Gid),
+				"--groups=" + formatGroups(identity.Groups),
+				"--",
+			}
+		}
+	}
+	if nr.WorkDir != "" {
+		nspawnArgs = append(nspawnArgs, "--chdir="+nr.WorkDir)
+	}
+	for _, pair := range sortedEnv(envVars) {
+		nspawnArgs = append(nspawnArgs, "--setenv="+pair)
+	}
+	nspawnArgs = append(nspawnArgs, setpriv...)
+	nspawnArgs = append(nspawnArgs, "/bin/sh", "-c", command)
+
+	cmd := exec.Command(nr.getNspawnCommand(), nspawnArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	fmt.Printf("Executing command in nspawn container %s: %s\n", nr.target(), command)
+	err := cmd.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running command in nspawn container: %s, %v\n", command, err)
+		return err
+	}
+	return nil
+}
+
+func (nr *NspawnRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
+	rootDir, err := nr.RootDir()
+	if err != nil {
+		return err
+	}
+	return copyToRootfs(nr.BaseDir, rootDir, srcPattern, dest, isAdd)
+}
+
+func (nr *NspawnRunner) setWorkdir(dir string) {
+	nr.WorkDir = dir
+}
+
+func (nr *NspawnRunner) probe(script string, input io.Reader) ([]byte, error) {
+	// Pass stdin on to the container
+	nspawnArgs := append(nr.containerArgs(), "--console=pipe", "/bin/sh", "-c", script)
+	cmd := exec.Command(nr.getNspawnCommand(), nspawnArgs...)
+	cmd.Stdin = input
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// containerArgs returns the systemd-nspawn options selecting the container
+func (nr *NspawnRunner) containerArgs() []string {
+	nspawnArgs := []string{"--quiet", "--as-pid2", "--register=no"}
+	if nr.Directory != "" {
+		return append(nspawnArgs, "--directory="+nr.Directory)
+	}
+	return append(nspawnArgs, "--machine="+nr.Machine)
+}
+
+func (nr *NspawnRunner) resolveUser(spec UserSpec) (*Identity, error) {
+	rootDir, err := nr.RootDir()
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := loadRootfsAccounts(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	return accounts.resolve(spec)
+}
+
+// RootDir returns the rootfs directory of the container, resolving machine
+// images through machinectl
+func (nr *NspawnRunner) RootDir() (string, error) {
+	if nr.Directory != "" {
+		return nr.Directory, nil
+	}
+
+	out, err := exec.Command("machinectl", "show-image", nr.Machine, "--property=Path", "--value").Output()
+	if err != nil {
+		return "", fmt.Errorf("error resolving image path for machine %s: %w", nr.Machine, err)
+	}
+	rootDir := strings.TrimSpace(string(out))
+	info, err := os.Stat(rootDir)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("image for machine %s is not a directory: %s", nr.Machine, rootDir)
+	}
+	return rootDir, nil
+}
+
+func (nr *NspawnRunner) target() string {
+	if nr.Directory != "" {
+		return nr.Directory
+	}
+	return nr.Machine
+}
+
+func (nr *NspawnRunner) getNspawnCommand() string {
+	if nr.NspawnBinary != "" {
+		return nr.NspawnBinary
+	}
+	return "systemd-nspawn"
+}
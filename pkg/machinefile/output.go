@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// outputRunner is implemented by runners that can send their output somewhere
+// other than the process stdout and stderr
+type outputRunner interface {
+	stdout() io.Writer
+	stderr() io.Writer
+}
+
+// runnerStdout returns the writer for progress messages about a runner
+func runnerStdout(runner Runner) io.Writer {
+	if or, ok := runner.(outputRunner); ok {
+		return or.stdout()
+	}
+	return os.Stdout
+}
+
+// runnerStderr returns the writer for error messages about a runner
+func runnerStderr(runner Runner) io.Writer {
+	if or, ok := runner.(outputRunner); ok {
+		return or.stderr()
+	}
+	return os.Stderr
+}
+
+// outputMutex serializes writes of prefixed lines from concurrent runners
+var outputMutex sync.Mutex
+
+// PrefixWriter prepends a prefix to every line written to it, so output of
+// runners executing in parallel can be told apart
+type PrefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{w: w, prefix: prefix}
+}
+
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := pw.writeLine(pw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes out a pending partial line
+func (pw *PrefixWriter) Flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	err := pw.writeLine(append(pw.buf, '\n'))
+	pw.buf = nil
+	return err
+}
+
+func (pw *PrefixWriter) writeLine(line []byte) error {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	_, err := pw.w.Write(append([]byte(pw.prefix), line...))
+	return err
+}
@@ -1,146 +1,583 @@
 package internal
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/user"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func ParseAndRunDockerfile(dockerfilePath string, runner Runner, predefinedArgs map[string]string) error {
-	file, err := os.Open(dockerfilePath)
+// builtinArgs are predefined by machinefile or Docker and do not cause a
+// warning when they are not declared
+var builtinArgs = map[string]bool{
+	"MACHINEFILE":     true,
+	"BUILDKIT_SYNTAX": true,
+	"BUILD_DATE":      true,
+
+	"TARGETOS":              true,
+	"TARGETARCH":            true,
+	"TARGETVARIANT":         true,
+	"TARGETPLATFORM":        true,
+	"BUILDPLATFORM":         true,
+	"TARGET_HOSTNAME":       true,
+	"TARGET_DISTRO_ID":      true,
+	"TARGET_DISTRO_VERSION": true,
+
+	"HTTP_PROXY":  true,
+	"http_proxy":  true,
+	"HTTPS_PROXY": true,
+	"https_proxy": true,
+	"FTP_PROXY":   true,
+	"ftp_proxy":   true,
+	"NO_PROXY":    true,
+	"no_proxy":    true,
+	"ALL_PROXY":   true,
+	"all_proxy":   true,
+}
+
+// stage holds the state of a build stage. ARGs are scoped to the stage that
+// declares them, while ENV, USER, WORKDIR, ENTRYPOINT, CMD and the recorded
+// metadata carry over to stages built FROM it.
+type stage struct {
+	Name        string
+	User        string
+	Workdir     string
+	Env         map[string]string
+	Args        map[string]string
+	Entrypoint  *execCommand
+	Cmd         *execCommand
+	Healthcheck *healthcheck
+	Expose      []exposedPort
+	Volumes     []string
+	Labels      map[string]string
+	StopSignal  string
+}
+
+func newStage() *stage {
+	return &stage{
+		Env:    make(map[string]string),
+		Args:   make(map[string]string),
+		Labels: make(map[string]string),
+	}
+}
+
+// vars returns the variables visible to instructions of the stage, where ENV
+// takes precedence over an ARG of the same name
+func (st *stage) vars() map[string]string {
+	vars := make(map[string]string, len(st.Args)+len(st.Env))
+	for k, v := range st.Args {
+		vars[k] = v
+	}
+	for k, v := range st.Env {
+		vars[k] = v
+	}
+	return vars
+}
+
+// DeclaredArgs returns the names of all ARGs declared in the Dockerfile
+func (df *Dockerfile) DeclaredArgs() map[string]bool {
+	declared := make(map[string]bool)
+	for _, inst := range df.Instructions {
+		if inst.Command != "ARG" {
+			continue
+		}
+		for _, word := range splitWords(inst.Args, df.EscapeToken) {
+			key, _, _ := strings.Cut(word, "=")
+			declared[key] = true
+		}
+	}
+	return declared
+}
+
+// unusedArgs returns the names of predefined ARGs that are not declared
+func unusedArgs(df *Dockerfile, predefinedArgs map[string]string) []string {
+	declared := df.DeclaredArgs()
+	var unused []string
+	for key := range predefinedArgs {
+		if !declared[key] && !builtinArgs[key] {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// needsFacts reports whether running the Dockerfile needs the facts of the
+// target, which costs a round trip: for conditions on facts, platform ARGs
+// that are declared or used in FROM, and EXPOSE ports to open in the firewall
+func needsFacts(df *Dockerfile, options Options) bool {
+	declared := df.DeclaredArgs()
+	platformArgs := (&Platform{}).Args()
+	for name := range platformArgs {
+		if declared[name] {
+			return true
+		}
+	}
+	for _, inst := range df.Instructions {
+		if inst.When != "" {
+			if node, err := parseCondition(inst.When); err == nil && node.usesFacts() {
+				return true
+			}
+		}
+		switch inst.Command {
+		case "FROM":
+			for name := range platformArgs {
+				if strings.Contains(inst.Args, name) {
+					return true
+				}
+			}
+		case "EXPOSE":
+			if options.ApplyExpose {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasFrom reports whether the instructions contain a FROM. Files without one
+// have a single implicit stage, so their ARGs are not global.
+func hasFrom(instructions []*Instruction) bool {
+	for _, inst := range instructions {
+		if inst.Command == "FROM" {
+			return true
+		}
+	}
+	return false
+}
+
+// Options select opt-in behavior for running a Dockerfile on a machine
+type Options struct {
+	InstallService   string // Name of a systemd service to install from the final ENTRYPOINT and CMD
+	HealthcheckTimer bool   // Install the HEALTHCHECK as a systemd timer next to the service
+	ApplyExpose      bool   // Open the EXPOSE ports of the final stage in the firewall
+	NoManifest       bool   // Do not write the manifest to ManifestPath on the target
+}
+
+func ParseAndRunDockerfile(dockerfilePath string, runner Runner, predefinedArgs map[string]string, options Options) error {
+	content, err := os.ReadFile(dockerfilePath)
 	if err != nil {
 		return fmt.Errorf("error opening Dockerfile: %w", err)
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	var currentUser string
-	envVars := make(map[string]string)
-	
-	// Add built-in ARGs
-	//currentTime := time.Now().UTC()
-	//envVars["BUILDKIT_SYNTAX"] = ""  // Common ARG in Containerfiles
-	//envVars["BUILD_DATE"] = `"` + currentTime.Format("2025-03-01 17:05:30") + `"`
-	
-	// Add predefined ARGs from command line
+
+	df, err := ParseDockerfile(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	instructions := df.Instructions
+	escape := df.EscapeToken
+
+	out := runnerStdout(runner)
+	if unused := unusedArgs(df, predefinedArgs); len(unused) > 0 {
+		fmt.Fprintf(runnerStderr(runner), "[Warning] One or more build-args %v were not consumed\n", unused)
+	}
+	if df.Syntax != "" {
+		fmt.Fprintf(out, "Recorded syntax %s, instructions are parsed by machinefile itself\n", df.Syntax)
+		for _, feature := range df.UnsupportedFeatures() {
+			fmt.Fprintf(runnerStderr(runner), "[Warning] Unsupported feature of syntax %s: %s\n", df.Syntax, feature)
+		}
+	}
+
+	// ARGs before the first FROM are global and only usable in FROM, unless
+	// a stage redeclares them. Built-in ARGs are global as well, with the
+	// platform ARGs detected on the target.
+	globalArgs := make(map[string]string)
+	var facts *Facts
+	if needsFacts(df, options) {
+		facts, err = GatherFacts(runner)
+		if err != nil {
+			fmt.Fprintf(runnerStderr(runner), "[Warning] Unable to gather facts of target: %v\n", err)
+		} else {
+			platform := facts.Platform()
+			fmt.Fprintf(out, "Detected target platform %s (%s %s) on %s\n", platform, platform.DistroID, platform.DistroVersion, platform.Hostname)
+			for k, v := range platform.Args() {
+				globalArgs[k] = v
+			}
+		}
+	}
 	for k, v := range predefinedArgs {
-		envVars[k] = v
-		fmt.Printf("Using predefined ARG %s=%s\n", k, v)
-	}
-	
-	var runCommandBuilder strings.Builder
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
-			if strings.HasPrefix(line, "RUN ") || runCommandBuilder.Len() > 0 {
-				if strings.HasSuffix(line, "\\") {
-					runCommandBuilder.WriteString(strings.TrimSuffix(line, "\\"))
-					runCommandBuilder.WriteString(" ")
-				} else {
-					if runCommandBuilder.Len() > 0 {
-						runCommandBuilder.WriteString(line)
-						command := runCommandBuilder.String()
-						runCommandBuilder.Reset()
-
-						if strings.HasPrefix(command, "RUN ") {
-							command = strings.TrimPrefix(command, "RUN ")
-						}
-
-						if err := runner.RunCommand(command, currentUser, envVars); err != nil {
-							return fmt.Errorf("error running command: %w", err)
-						}
-					} else {
-						command := strings.TrimPrefix(line, "RUN ")
-						if err := runner.RunCommand(command, currentUser, envVars); err != nil {
-							return fmt.Errorf("error running command: %w", err)
-						}
-					}
-				}
-			} else if strings.HasPrefix(line, "COPY ") {
-				parts := strings.Fields(strings.TrimPrefix(line, "COPY "))
-				if len(parts) == 2 {
-					srcPattern := expandVariables(parts[0], envVars)
-					dest := expandVariables(parts[1], envVars)
-					if err := runner.CopyFile(srcPattern, dest, false); err != nil {
-						return fmt.Errorf("error copying file: %w", err)
-					}
-				} else {
-					return fmt.Errorf("invalid COPY command: %s", line)
-				}
-			} else if strings.HasPrefix(line, "ADD ") {
-				parts := strings.Fields(strings.TrimPrefix(line, "ADD "))
-				if len(parts) == 2 {
-					srcPattern := expandVariables(parts[0], envVars)
-					dest := expandVariables(parts[1], envVars)
-					if err := runner.CopyFile(srcPattern, dest, true); err != nil {
-						return fmt.Errorf("error adding file: %w", err)
-					}
-				} else {
-					return fmt.Errorf("invalid ADD command: %s", line)
-				}
-			} else if strings.HasPrefix(line, "USER ") {
-				userValue := strings.TrimPrefix(line, "USER ")
-				// Expand variables in USER command
-				currentUser = expandVariables(userValue, envVars)
-				fmt.Printf("Switching to user: %s\n", currentUser)
-				
-				if _, ok := runner.(*LocalRunner); ok {
-					_, err := user.Lookup(currentUser)
-					if err != nil {
-						return fmt.Errorf("error looking up user: %w", err)
-					}
-				}
-			} else if strings.HasPrefix(line, "ENV ") {
-				env := strings.TrimPrefix(line, "ENV ")
-				parts := strings.SplitN(env, "=", 2)
-				if len(parts) == 2 {
-					// Expand variables in ENV values
-					value := strings.Trim(parts[1], "\"'")
-					envVars[parts[0]] = expandVariables(value, envVars)
-					fmt.Printf("Set ENV %s=%s\n", parts[0], envVars[parts[0]])
-				} else {
-					return fmt.Errorf("invalid ENV command: %s", line)
+		if builtinArgs[k] {
+			globalArgs[k] = v
+		}
+	}
+	var current *stage
+	if !hasFrom(instructions) {
+		current = newStage()
+	}
+	stages := make(map[string]*stage)
+	var allStages []*stage
+
+	skipped := 0
+	for _, inst := range instructions {
+		if inst.When != "" {
+			if inst.Command == "FROM" {
+				return fmt.Errorf("FROM on line %d can not be conditional", inst.Line)
+			}
+			vars := globalArgs
+			if current != nil {
+				vars = current.vars()
+			}
+			ok, err := EvaluateCondition(inst.When, vars, facts)
+			if err != nil {
+				return fmt.Errorf("error evaluating condition on line %d: %w", inst.Line, err)
+			}
+			if !ok {
+				fmt.Fprintf(out, "Skipping %s on line %d, condition is false: %s\n", inst.Command, inst.Line, inst.When)
+				skipped++
+				continue
+			}
+		}
+
+		if inst.Command == "FROM" {
+			current, err = startStage(out, inst, globalArgs, stages, escape)
+			if err != nil {
+				return err
+			}
+			allStages = append(allStages, current)
+			applyWorkdir(runner, current.Workdir)
+			continue
+		}
+
+		if current == nil {
+			if inst.Command != "ARG" {
+				return fmt.Errorf("%s on line %d must follow FROM", inst.Command, inst.Line)
+			}
+			if err := declareArgs(out, inst, escape, globalArgs, globalArgs, globalArgs, predefinedArgs); err != nil {
+				return err
+			}
+			continue
+		}
+
+		vars := current.vars()
+		switch inst.Command {
+		case "RUN":
+			if err := runner.RunCommand(inst.Args, current.User, vars); err != nil {
+				return fmt.Errorf("error running command: %w", err)
+			}
+		case "COPY", "ADD":
+			words, err := processWords(inst, vars, escape)
+			if err != nil {
+				return err
+			}
+			if len(words) != 2 {
+				return fmt.Errorf("invalid %s command: %s", inst.Command, inst)
+			}
+			if err := runner.CopyFile(words[0], workdirPath(current, words[1]), inst.Command == "ADD"); err != nil {
+				if inst.Command == "ADD" {
+					return fmt.Errorf("error adding file: %w", err)
 				}
-			} else if strings.HasPrefix(line, "ARG ") {
-				arg := strings.TrimPrefix(line, "ARG ")
-				parts := strings.SplitN(arg, "=", 2)
-				key := parts[0]
-                
-				// First check if the ARG was provided via command line
-				if value, exists := predefinedArgs[key]; exists {
-					// Command line ARG takes precedence
-					envVars[key] = value
-					fmt.Printf("Using command line ARG %s=%s\n", key, value)
-				} else if len(parts) == 2 {
-					// If not provided via command line, use default from Dockerfile
-					value := strings.Trim(parts[1], "\"'")
-					envVars[key] = expandVariables(value, envVars)
-					fmt.Printf("Using Dockerfile default ARG %s=%s\n", key, envVars[key])
-				} else {
-					// If no default value and not provided via command line, try environment
-					envVars[key] = os.Getenv(key)
-					if envVars[key] != "" {
-						fmt.Printf("Using environment ARG %s=%s\n", key, envVars[key])
-					} else {
-						fmt.Printf("ARG %s has no value set\n", key)
-					}
+				return fmt.Errorf("error copying file: %w", err)
+			}
+		case "USER":
+			userValue, err := processWord(inst.Args, vars, escape)
+			if err != nil {
+				return fmt.Errorf("invalid USER command on line %d: %w", inst.Line, err)
+			}
+			current.User = userValue
+			fmt.Fprintf(out, "Switching to user: %s\n", current.User)
+
+			spec, err := ParseUserSpec(current.User)
+			if err != nil {
+				return err
+			}
+			if resolver, ok := runner.(userResolver); ok {
+				identity, err := resolver.resolveUser(spec)
+				if err != nil {
+					return fmt.Errorf("error looking up user: %w", err)
 				}
+				fmt.Fprintf(out, "Resolved user %s to uid=%d gid=%d groups=%s\n", spec, identity.Uid, identity.Gid, formatGroups(identity.Groups))
+			}
+		case "ENV":
+			// Values are expanded against the variables before this
+			// instruction, so ENV A=1 B=$A does not see the new A
+			assignments, err := parseAssignments("ENV", inst.Args, vars, escape, true)
+			if err != nil {
+				return fmt.Errorf("invalid ENV command on line %d: %w", inst.Line, err)
+			}
+			for _, env := range assignments {
+				current.Env[env.Key] = env.Value
+				fmt.Fprintf(out, "Set ENV %s=%s\n", env.Key, env.Value)
+			}
+		case "ARG":
+			if err := declareArgs(out, inst, escape, current.Args, vars, globalArgs, predefinedArgs); err != nil {
+				return err
+			}
+		case "WORKDIR":
+			workdir, err := processWord(inst.Args, vars, escape)
+			if err != nil {
+				return fmt.Errorf("invalid WORKDIR command on line %d: %w", inst.Line, err)
+			}
+			if !filepath.IsAbs(workdir) {
+				workdir = filepath.Join(stageWorkdir(current), workdir)
+			}
+			fmt.Fprintf(out, "Changing to WORKDIR %s\n", workdir)
+			if err := runner.RunCommand("mkdir -p "+shellQuote(workdir), "", nil); err != nil {
+				return fmt.Errorf("error creating workdir: %w", err)
+			}
+			current.Workdir = workdir
+			applyWorkdir(runner, workdir)
+		case "ENTRYPOINT":
+			entrypoint := parseExecCommand(inst.Args)
+			current.Entrypoint = &entrypoint
+			fmt.Fprintf(out, "Recorded ENTRYPOINT %q for the service\n", entrypoint.argv())
+		case "CMD":
+			cmd := parseExecCommand(inst.Args)
+			current.Cmd = &cmd
+			fmt.Fprintf(out, "Recorded CMD %q for the service\n", cmd.argv())
+		case "EXPOSE":
+			words, err := processWords(inst, vars, escape)
+			if err != nil {
+				return err
+			}
+			ports, err := parseExposedPorts(words)
+			if err != nil {
+				return fmt.Errorf("invalid EXPOSE command on line %d: %w", inst.Line, err)
+			}
+			current.Expose = append(append([]exposedPort{}, current.Expose...), ports...)
+			if options.ApplyExpose {
+				fmt.Fprintf(out, "Recorded EXPOSE %s to open in the firewall after all steps\n", formatPorts(ports))
+			} else {
+				fmt.Fprintf(out, "Recorded EXPOSE %s, not applied (use --apply-expose to open it in the firewall)\n", formatPorts(ports))
+			}
+		case "VOLUME":
+			volumes, err := processList(inst, vars, escape)
+			if err != nil {
+				return err
+			}
+			if len(volumes) == 0 {
+				return fmt.Errorf("VOLUME on line %d requires at least one path", inst.Line)
+			}
+			fmt.Fprintf(out, "Creating VOLUME %s\n", strings.Join(volumes, " "))
+			var quoted []string
+			for _, volume := range volumes {
+				quoted = append(quoted, shellQuote(volume))
+			}
+			if err := runner.RunCommand("mkdir -p "+strings.Join(quoted, " "), "", nil); err != nil {
+				return fmt.Errorf("error creating volume: %w", err)
+			}
+			current.Volumes = append(append([]string{}, current.Volumes...), volumes...)
+		case "LABEL":
+			labels, err := parseAssignments("LABEL", inst.Args, vars, escape, true)
+			if err != nil {
+				return fmt.Errorf("invalid LABEL command on line %d: %w", inst.Line, err)
+			}
+			for _, label := range labels {
+				current.Labels[label.Key] = label.Value
+				fmt.Fprintf(out, "Recorded LABEL %s=%s\n", label.Key, label.Value)
+			}
+		case "STOPSIGNAL":
+			signal, err := processWord(inst.Args, vars, escape)
+			if err != nil {
+				return fmt.Errorf("invalid STOPSIGNAL command on line %d: %w", inst.Line, err)
+			}
+			current.StopSignal = signal
+			fmt.Fprintf(out, "Recorded STOPSIGNAL %s\n", signal)
+		case "HEALTHCHECK":
+			check, err := parseHealthcheck(inst.Args)
+			if err != nil {
+				return fmt.Errorf("invalid HEALTHCHECK command on line %d: %w", inst.Line, err)
+			}
+			current.Healthcheck = check
+			if check == nil {
+				fmt.Fprintf(out, "Disabled HEALTHCHECK\n")
 			} else {
-				fmt.Printf("Unsupported command: %s\n", line)
+				fmt.Fprintf(out, "Recorded HEALTHCHECK %s to verify after all steps\n", check.script())
+			}
+		default:
+			fmt.Fprintf(out, "Unsupported command: %s\n", inst)
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(out, "Skipped %d of %d instructions due to conditions\n", skipped, len(instructions))
+	}
+
+	if options.InstallService != "" {
+		if current == nil {
+			return fmt.Errorf("no stage to install as service %s", options.InstallService)
+		}
+		if err := installService(runner, options.InstallService, dockerfilePath, current, options.HealthcheckTimer); err != nil {
+			return err
+		}
+	}
+
+	if options.ApplyExpose && current != nil {
+		if err := applyExpose(runner, current.Expose, facts); err != nil {
+			return err
+		}
+	}
+
+	if current != nil && current.Healthcheck != nil {
+		// A check of an application defined by ENTRYPOINT and CMD can only
+		// pass when it was started as a service
+		if options.InstallService == "" && (current.Entrypoint != nil || current.Cmd != nil) {
+			fmt.Fprintf(out, "Skipping HEALTHCHECK, ENTRYPOINT and CMD only run with --install-service\n")
+		} else if err := verifyHealth(runner, current.Healthcheck, current.User, current.vars()); err != nil {
+			return err
+		}
+	}
+
+	if !options.NoManifest && current != nil {
+		usedArgs := make(map[string]string)
+		declared := df.DeclaredArgs()
+		for k, v := range globalArgs {
+			if declared[k] {
+				usedArgs[k] = v
+			}
+		}
+		if len(allStages) == 0 {
+			allStages = append(allStages, current)
+		}
+		for _, st := range allStages {
+			for k, v := range st.Args {
+				usedArgs[k] = v
 			}
 		}
+		manifest := newManifest(dockerfilePath, content, current, usedArgs)
+		if err := writeManifest(runner, manifest); err != nil {
+			fmt.Fprintf(runnerStderr(runner), "[Warning] Unable to write manifest to %s: %v\n", ManifestPath, err)
+		}
+	}
+	return nil
+}
+
+// processList processes the arguments of an instruction in JSON array form,
+// like VOLUME ["/data"], or as words
+func processList(inst *Instruction, vars map[string]string, escape rune) ([]string, error) {
+	if strings.HasPrefix(inst.Args, "[") {
+		var list []string
+		if err := json.Unmarshal([]byte(inst.Args), &list); err == nil {
+			for i, item := range list {
+				value, err := processWord(item, vars, escape)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s command on line %d: %w", inst.Command, inst.Line, err)
+				}
+				list[i] = value
+			}
+			return list, nil
+		}
+	}
+	return processWords(inst, vars, escape)
+}
+
+// stageWorkdir returns the working directory relative WORKDIRs build on
+func stageWorkdir(st *stage) string {
+	if st.Workdir == "" {
+		return "/"
+	}
+	return st.Workdir
+}
+
+// workdirPath returns a destination relative to the WORKDIR of the stage as
+// an absolute path. Without WORKDIR, relative paths are left to the runner.
+func workdirPath(st *stage, dest string) string {
+	if st.Workdir == "" || filepath.IsAbs(dest) {
+		return dest
+	}
+	resolved := filepath.Join(st.Workdir, dest)
+	if strings.HasSuffix(dest, "/") && resolved != "/" {
+		resolved += "/"
 	}
+	return resolved
+}
 
-	if runCommandBuilder.Len() > 0 {
-		return fmt.Errorf("RUN command not properly terminated")
+// applyWorkdir makes the runner run later steps in dir, or the directory it
+// started in when dir is empty
+func applyWorkdir(runner Runner, dir string) {
+	if wr, ok := runner.(workdirRunner); ok {
+		wr.setWorkdir(dir)
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading Dockerfile: %w", err)
+// startStage begins the stage of a FROM instruction. The image is expanded
+// with the global ARGs only. A stage built FROM an earlier stage inherits
+// its ENV and USER.
+func startStage(out io.Writer, inst *Instruction, globalArgs map[string]string, stages map[string]*stage, escape rune) (*stage, error) {
+	words, err := processWords(inst, globalArgs, escape)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) != 1 && (len(words) != 3 || !strings.EqualFold(words[1], "AS")) {
+		return nil, fmt.Errorf("invalid FROM command: %s", inst)
 	}
 
+	next := newStage()
+	if len(words) == 3 {
+		next.Name = strings.ToLower(words[2])
+	}
+	if parent, ok := stages[strings.ToLower(words[0])]; ok {
+		next.User = parent.User
+		next.Workdir = parent.Workdir
+		next.Entrypoint = parent.Entrypoint
+		next.Cmd = parent.Cmd
+		next.Healthcheck = parent.Healthcheck
+		next.Expose = parent.Expose
+		next.Volumes = parent.Volumes
+		next.StopSignal = parent.StopSignal
+		for k, v := range parent.Env {
+			next.Env[k] = v
+		}
+		for k, v := range parent.Labels {
+			next.Labels[k] = v
+		}
+	}
+	if next.Name != "" {
+		stages[next.Name] = next
+	}
+	fmt.Fprintf(out, "Starting stage: FROM %s\n", strings.Join(words, " "))
+	return next, nil
+}
+
+// declareArgs sets the ARGs of an instruction in args. The value is taken
+// from the command line, the default in the file, the global ARG of the same
+// name, or the environment, in that order.
+func declareArgs(out io.Writer, inst *Instruction, escape rune, args, vars, globalArgs, predefinedArgs map[string]string) error {
+	assignments, err := parseAssignments("ARG", inst.Args, vars, escape, false)
+	if err != nil {
+		return fmt.Errorf("invalid ARG command on line %d: %w", inst.Line, err)
+	}
+	for _, arg := range assignments {
+		key := arg.Key
+		// First check if the ARG was provided via command line
+		if value, exists := predefinedArgs[key]; exists {
+			// Command line ARG takes precedence
+			args[key] = value
+			fmt.Fprintf(out, "Using command line ARG %s=%s\n", key, value)
+		} else if arg.HasValue {
+			// If not provided via command line, use default from Dockerfile
+			args[key] = arg.Value
+			fmt.Fprintf(out, "Using Dockerfile default ARG %s=%s\n", key, args[key])
+		} else if value, exists := globalArgs[key]; exists {
+			// Redeclaring a global ARG makes it available in the stage
+			args[key] = value
+			fmt.Fprintf(out, "Using global ARG %s=%s\n", key, value)
+		} else {
+			// If no default value and not provided via command line, try environment
+			args[key] = os.Getenv(key)
+			if args[key] != "" {
+				fmt.Fprintf(out, "Using environment ARG %s=%s\n", key, args[key])
+			} else {
+				fmt.Fprintf(out, "ARG %s has no value set\n", key)
+			}
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// processWords splits the arguments of an instruction into words and
+// processes each against vars
+func processWords(inst *Instruction, vars map[string]string, escape rune) ([]string, error) {
+	var words []string
+	for _, word := range splitWords(inst.Args, escape) {
+		value, err := processWord(word, vars, escape)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s command on line %d: %w", inst.Command, inst.Line, err)
+		}
+		words = append(words, value)
+	}
+	return words, nil
+}
@@ -0,0 +1,58 @@
+package internal
+
+import "runtime"
+
+// Platform describes the target platform as provided in the built-in ARGs
+type Platform struct {
+	OS            string // Operating system, like linux
+	Architecture  string // Architecture in GOARCH notation, like amd64
+	Variant       string // Architecture variant, like v7 for arm
+	Hostname      string
+	DistroID      string // ID from os-release, like fedora
+	DistroVersion string // VERSION_ID from os-release, like 41
+}
+
+// String returns the platform as os/arch[/variant]
+func (p *Platform) String() string {
+	platform := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		platform += "/" + p.Variant
+	}
+	return platform
+}
+
+// Args returns the built-in platform ARGs for the target
+func (p *Platform) Args() map[string]string {
+	return map[string]string{
+		"TARGETOS":              p.OS,
+		"TARGETARCH":            p.Architecture,
+		"TARGETVARIANT":         p.Variant,
+		"TARGETPLATFORM":        p.String(),
+		"BUILDPLATFORM":         runtime.GOOS + "/" + runtime.GOARCH,
+		"TARGET_HOSTNAME":       p.Hostname,
+		"TARGET_DISTRO_ID":      p.DistroID,
+		"TARGET_DISTRO_VERSION": p.DistroVersion,
+	}
+}
+
+// normalizeArch maps the machine reported by uname -m to the architecture
+// and variant names used for container platforms
+func normalizeArch(machine string) (string, string) {
+	switch machine {
+	case "x86_64", "amd64":
+		return "amd64", ""
+	case "aarch64", "arm64":
+		return "arm64", ""
+	case "armv8l", "armv7l", "armv7":
+		return "arm", "v7"
+	case "armv6l", "armv6":
+		return "arm", "v6"
+	case "armv5tel", "armv5l":
+		return "arm", "v5"
+	case "i386", "i486", "i586", "i686":
+		return "386", ""
+	case "loongarch64":
+		return "loong64", ""
+	}
+	return machine, ""
+}
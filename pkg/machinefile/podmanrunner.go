@@ -2,10 +2,10 @@ package internal
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 )
 
 type PodmanRunner struct {
@@ -13,29 +13,29 @@ type PodmanRunner struct {
 	ContainerName string
 	ConnectionName string // Podman connection name
 	PodmanBinary  string  // Path to Podman binary
+	WorkDir       string  // Working directory of steps, set by WORKDIR
 }
 
 func (pr *PodmanRunner) RunCommand(command string, userName string, envVars map[string]string) error {
-	expandedCommand := expandVariables(command, envVars)
-	podmanCommand := []string{"exec", pr.ContainerName, "sh", "-c", expandedCommand}
-
-	if len(envVars) > 0 {
-		envPrefix := ""
-		for key, value := range envVars {
-			envPrefix += fmt.Sprintf("%s=%s ", key, value)
-		}
-		podmanCommand = append([]string{"exec", pr.ContainerName, "sh", "-c", envPrefix + expandedCommand})
-	}
-	
+	podmanCommand := pr.connectionArgs()
+	podmanCommand = append(podmanCommand, "exec")
 	if userName != "" {
-		podmanCommand = append([]string{"exec", "--user", userName, pr.ContainerName, "sh", "-c", expandedCommand})
+		podmanCommand = append(podmanCommand, "--user", userName)
+	}
+	if pr.WorkDir != "" {
+		podmanCommand = append(podmanCommand, "--workdir", pr.WorkDir)
 	}
+	// Pass variables as arguments, so values need no shell quoting
+	for _, pair := range sortedEnv(envVars) {
+		podmanCommand = append(podmanCommand, "--env", pair)
+	}
+	podmanCommand = append(podmanCommand, pr.ContainerName, "sh", "-c", command)
 
-	cmd := exec.Command(pr.getPodmanCommand(), podmanCommand...)
+	cmd := exec.Command(pr.PodmanBinary, podmanCommand...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	
-	fmt.Printf("Executing command in container: %s\n", strings.Join(podmanCommand, " "))
+	fmt.Printf("Executing command in container: %s\n", command)
 	err := cmd.Run()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error running command in container: %s, %v\n", command, err)
@@ -61,7 +61,8 @@ func (pr *PodmanRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
 	}
 	
 	for _, src := range matches {
-		cmd := exec.Command(pr.getPodmanCommand(), "cp", src, fmt.Sprintf("%s:%s", pr.ContainerName, dest))
+		podmanCommand := append(pr.connectionArgs(), "cp", src, fmt.Sprintf("%s:%s", pr.ContainerName, dest))
+		cmd := exec.Command(pr.PodmanBinary, podmanCommand...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		
@@ -75,10 +76,44 @@ func (pr *PodmanRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
 	return nil
 }
 
-func (pr *PodmanRunner) getPodmanCommand() string {
-	command := pr.PodmanBinary
+func (pr *PodmanRunner) setWorkdir(dir string) {
+	pr.WorkDir = dir
+}
+
+// resolveUser validates USER against the passwd and group files of the
+// container, which podman exec --user resolves against as well
+func (pr *PodmanRunner) resolveUser(spec UserSpec) (*Identity, error) {
+	passwd, err := pr.output("cat", "/etc/passwd")
+	if err != nil {
+		return nil, fmt.Errorf("error reading passwd database of container: %w", err)
+	}
+	group, _ := pr.output("cat", "/etc/group")
+	return parseAccountDB(passwd, group).resolve(spec)
+}
+
+func (pr *PodmanRunner) probe(script string, input io.Reader) ([]byte, error) {
+	podmanArgs := pr.connectionArgs()
+	podmanArgs = append(podmanArgs, "exec", "--interactive", pr.ContainerName, "sh", "-c", script)
+	cmd := exec.Command(pr.PodmanBinary, podmanArgs...)
+	cmd.Stdin = input
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// output runs a command in the container and returns its stdout
+func (pr *PodmanRunner) output(args ...string) ([]byte, error) {
+	podmanArgs := pr.connectionArgs()
+	podmanArgs = append(podmanArgs, "exec", pr.ContainerName)
+	podmanArgs = append(podmanArgs, args...)
+	cmd := exec.Command(pr.PodmanBinary, podmanArgs...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// connectionArgs returns the global podman options selecting the connection
+func (pr *PodmanRunner) connectionArgs() []string {
 	if pr.ConnectionName != "" {
-		command = fmt.Sprintf("%s --connection=%s", pr.PodmanBinary, pr.ConnectionName)
+		return []string{"--connection=" + pr.ConnectionName}
 	}
-	return command
+	return nil
 }
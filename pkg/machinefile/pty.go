@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty allocates a pseudo terminal and returns its master and slave ends
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening pty: %w", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("error unlocking pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("error getting pty number: %w", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("error opening pty slave: %w", err)
+	}
+	return master, slave, nil
+}
+
+// runWithPty runs cmd on a new terminal, answering a password prompt with
+// password. Output of the terminal is written to out.
+func runWithPty(cmd *exec.Cmd, password string, out io.Writer) error {
+	master, slave, err := openPty()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		slave.Close()
+		return err
+	}
+	slave.Close()
+
+	// Reading the master fails with EIO once the command has exited
+	err = answerPasswordPrompt(master, master, out, password)
+	if err != nil && !errors.Is(err, syscall.EIO) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks limits the symlinks followed when resolving a path, like the
+// kernel does
+const maxSymlinks = 40
+
+// resolveInRoot returns the host path of a path inside a rootfs, following
+// symlinks the way they resolve when the rootfs is the root: absolute
+// targets start at rootDir, and .. never leaves it. This keeps links like
+// /var/run -> /run from pointing at the host. Components that do not exist
+// yet are kept as they are.
+func resolveInRoot(rootDir, path string) (string, error) {
+	current := "/"
+	remaining := strings.Split(path, "/")
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(rootDir, next))
+		if os.IsNotExist(err) {
+			current = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(rootDir, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return filepath.Join(rootDir, current), nil
+}
+
+// copyToRootfs copies files from the context directly into a rootfs directory
+func copyToRootfs(baseDir, rootDir, srcPattern, dest string, isAdd bool) error {
+	srcPattern = filepath.Join(baseDir, srcPattern)
+	srcPattern = filepath.Clean(srcPattern)
+	rootDest, err := resolveInRoot(rootDir, dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving destination: %v\n", err)
+		return err
+	}
+
+	matches, err := filepath.Glob(srcPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error with glob pattern: %v\n", err)
+		return err
+	}
+
+	if len(matches) == 0 {
+		fmt.Fprintf(os.Stderr, "No matches found for pattern: %s\n", srcPattern)
+		return fmt.Errorf("no matches found")
+	}
+
+	for _, src := range matches {
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error stating source file: %v\n", err)
+			return err
+		}
+
+		var copyErr error
+		if srcInfo.IsDir() && isAdd {
+			if err := os.MkdirAll(rootDest, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating directory: %v\n", err)
+				return err
+			}
+			// Copy the directory contents, including dotfiles
+			copyErr = exec.Command("cp", "-a", src+"/.", rootDest+"/").Run()
+		} else {
+			destDir := filepath.Dir(rootDest)
+			if strings.HasSuffix(dest, "/") {
+				destDir = rootDest
+			}
+			if err := os.MkdirAll(destDir, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating directory: %v\n", err)
+				return err
+			}
+			copyErr = exec.Command("cp", "-a", src, rootDest).Run()
+		}
+
+		if copyErr != nil {
+			fmt.Fprintf(os.Stderr, "Error copying file: %v\n", copyErr)
+			return copyErr
+		}
+
+		if isAdd {
+			fmt.Printf("Added contents of %s to %s in %s\n", src, dest, rootDir)
+		} else {
+			fmt.Printf("Copied %s to %s in %s\n", src, dest, rootDir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnitDir is where units installed with --install-service are written
+const systemdUnitDir = "/etc/systemd/system"
+
+// execCommand is the command of a CMD or ENTRYPOINT instruction, in exec
+// form like ["nginx", "-g", "daemon off;"] or shell form like nginx -g ...
+type execCommand struct {
+	Args  []string
+	Shell bool
+}
+
+// parseExecCommand parses the JSON exec form, or takes the arguments as a
+// command for /bin/sh -c
+func parseExecCommand(args string) execCommand {
+	if strings.HasPrefix(args, "[") {
+		var execArgs []string
+		if err := json.Unmarshal([]byte(args), &execArgs); err == nil {
+			return execCommand{Args: execArgs}
+		}
+	}
+	return execCommand{Args: []string{args}, Shell: true}
+}
+
+// argv returns the command line, running the shell form with /bin/sh -c
+func (c *execCommand) argv() []string {
+	if c.Shell {
+		return []string{"/bin/sh", "-c", c.Args[0]}
+	}
+	return c.Args
+}
+
+// serviceCommand combines ENTRYPOINT and CMD like a container engine does
+func serviceCommand(entrypoint, cmd *execCommand) []string {
+	switch {
+	case entrypoint == nil && cmd == nil:
+		return nil
+	case entrypoint == nil:
+		return cmd.argv()
+	case entrypoint.Shell || cmd == nil:
+		// The shell form of ENTRYPOINT ignores CMD
+		return entrypoint.argv()
+	}
+	return append(append([]string{}, entrypoint.Args...), cmd.argv()...)
+}
+
+// systemdUnit returns a systemd service unit running the final ENTRYPOINT and
+// CMD of a stage with its USER, WORKDIR and ENV
+func systemdUnit(name, source string, st *stage) (string, error) {
+	command := serviceCommand(st.Entrypoint, st.Cmd)
+	if len(command) == 0 {
+		return "", fmt.Errorf("no ENTRYPOINT or CMD to install as service %s", name)
+	}
+
+	var unit strings.Builder
+	unit.WriteString("[Unit]\n")
+	fmt.Fprintf(&unit, "Description=%s (installed by machinefile from %s)\n", name, filepath.Base(source))
+	unit.WriteString("Wants=network-online.target\n")
+	unit.WriteString("After=network-online.target\n")
+	unit.WriteString("\n[Service]\n")
+	unit.WriteString("Type=simple\n")
+
+	var execStart []string
+	for _, arg := range command {
+		execStart = append(execStart, systemdQuote(arg, true))
+	}
+	fmt.Fprintf(&unit, "ExecStart=%s\n", strings.Join(execStart, " "))
+
+	if err := writeServiceContext(&unit, st); err != nil {
+		return "", err
+	}
+	if st.StopSignal != "" {
+		fmt.Fprintf(&unit, "KillSignal=%s\n", systemdSignal(st.StopSignal))
+	}
+	unit.WriteString("Restart=on-failure\n")
+	unit.WriteString("\n[Install]\n")
+	unit.WriteString("WantedBy=multi-user.target\n")
+	return unit.String(), nil
+}
+
+// writeServiceContext writes the USER, WORKDIR and ENV of the stage as
+// service settings
+func writeServiceContext(unit *strings.Builder, st *stage) error {
+	if st.User != "" {
+		spec, err := ParseUserSpec(st.User)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(unit, "User=%s\n", spec.User)
+		if spec.Group != "" {
+			fmt.Fprintf(unit, "Group=%s\n", spec.Group)
+		}
+	}
+	if st.Workdir != "" {
+		fmt.Fprintf(unit, "WorkingDirectory=%s\n", systemdEscape(st.Workdir))
+	}
+	for _, pair := range sortedEnv(st.Env) {
+		fmt.Fprintf(unit, "Environment=%s\n", systemdQuote(pair, false))
+	}
+	return nil
+}
+
+// systemdSignal returns a STOPSIGNAL like TERM or SIGTERM as the signal name
+// systemd expects
+func systemdSignal(signal string) string {
+	signal = strings.ToUpper(signal)
+	if isNumeric(signal) || strings.HasPrefix(signal, "SIG") {
+		return signal
+	}
+	return "SIG" + signal
+}
+
+// systemdQuote quotes a word for ExecStart or Environment, so systemd passes
+// it on unchanged without expanding specifiers, or variables in ExecStart
+func systemdQuote(word string, escapeVariables bool) string {
+	if word != "" && !strings.ContainsAny(word, " \t\n\"'\\$%;") {
+		return word
+	}
+	word = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(systemdEscape(word))
+	if escapeVariables {
+		word = strings.ReplaceAll(word, "$", "$$")
+	}
+	return `"` + word + `"`
+}
+
+// systemdEscape escapes the % that starts specifiers in unit files
+func systemdEscape(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// unitFile is a systemd unit to write to systemdUnitDir
+type unitFile struct {
+	name    string
+	content string
+}
+
+// installService writes a unit for the stage to the target through the runner
+// as the connecting user, which needs to be root or use --become, and enables
+// and (re)starts it. With healthcheckTimer, the HEALTHCHECK of the stage is
+// installed as a timer next to it.
+func installService(runner Runner, name, source string, st *stage, healthcheckTimer bool) error {
+	name = strings.TrimSuffix(name, ".service")
+	unit, err := systemdUnit(name, source, st)
+	if err != nil {
+		return err
+	}
+	units := []unitFile{{name + ".service", unit}}
+	start := []string{name + ".service"}
+
+	if healthcheckTimer {
+		if st.Healthcheck == nil {
+			return fmt.Errorf("no HEALTHCHECK to install as timer for service %s", name)
+		}
+		checkService, checkTimer, err := healthcheckUnits(name, st.Healthcheck, st)
+		if err != nil {
+			return err
+		}
+		units = append(units,
+			unitFile{name + "-healthcheck.service", checkService},
+			unitFile{name + "-healthcheck.timer", checkTimer})
+		start = append(start, name+"-healthcheck.timer")
+	}
+
+	// Units hold the ENV and ARG values, which can be secrets, so they are
+	// passed on stdin instead of being printed or put on a command line
+	out := runnerStdout(runner)
+	_, dryRun := runner.(*DryRunner)
+	p, ok := runner.(prober)
+	if !dryRun && !ok {
+		return fmt.Errorf("runner does not support writing files")
+	}
+	var script, cleanup strings.Builder
+	for _, u := range units {
+		unitPath := systemdUnitDir + "/" + u.name
+		if dryRun {
+			fmt.Fprintf(out, "Would install systemd unit %s\n", unitPath)
+			continue
+		}
+		fmt.Fprintf(out, "Installing systemd unit %s\n", unitPath)
+		temp, err := writeTempFile(p, []byte(u.content))
+		if err != nil {
+			return fmt.Errorf("error installing service %s: %w", name, err)
+		}
+		fmt.Fprintf(&script, "cat %s > %s && ", shellQuote(temp), shellQuote(unitPath))
+		fmt.Fprintf(&cleanup, " %s", shellQuote(temp))
+	}
+	script.WriteString("systemctl daemon-reload")
+	for _, unitName := range start {
+		fmt.Fprintf(&script, " && systemctl enable %s && systemctl restart %s", shellQuote(unitName), shellQuote(unitName))
+	}
+	if cleanup.Len() > 0 {
+		fmt.Fprintf(&script, "; status=$?; rm -f%s; exit $status", cleanup.String())
+	}
+	if err := runner.RunCommand(script.String(), "", nil); err != nil {
+		return fmt.Errorf("error installing service %s: %w", name, err)
+	}
+	return nil
+}
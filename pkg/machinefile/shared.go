@@ -1,16 +1,48 @@
 package internal
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 )
 
-func expandVariables(input string, envVars map[string]string) string {
-	result := input
-	// Match ${VAR} format
-	for key, value := range envVars {
-		result = strings.ReplaceAll(result, "${"+key+"}", value)
-		// Also handle $VAR format
-		result = strings.ReplaceAll(result, "$"+key, value)
+// sortedEnv returns the environment as KEY=value pairs in a stable order
+func sortedEnv(envVars map[string]string) []string {
+	keys := make([]string, 0, len(envVars))
+	for key := range envVars {
+		keys = append(keys, key)
 	}
-	return result
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", key, envVars[key]))
+	}
+	return env
+}
+
+// envExports returns a shell prefix that exports envVars with each value
+// quoted, so the variables reach the step unchanged after switching users
+// with sudo, doas or su, which reset the environment
+func envExports(envVars map[string]string) string {
+	if len(envVars) == 0 {
+		return ""
+	}
+	var exports strings.Builder
+	exports.WriteString("export")
+	for _, pair := range sortedEnv(envVars) {
+		key, value, _ := strings.Cut(pair, "=")
+		exports.WriteString(" " + key + "=" + shellQuote(value))
+	}
+	exports.WriteString("; ")
+	return exports.String()
+}
+
+// workdirPrefix returns a shell prefix that changes to the WORKDIR of a
+// step, failing the step when the directory can not be entered
+func workdirPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return "cd " + shellQuote(dir) + " || exit; "
 }
@@ -0,0 +1,817 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Shell variables of the exported script. ARGs and ENVs of the current stage
+// are kept as mf_NAME, global ARGs as mfg_NAME and ENVs saved for stages
+// built FROM a stage as mfs<index>_NAME, so they do not clash with the
+// environment of the script.
+const (
+	shellStageVar  = "mf_"
+	shellGlobalVar = "mfg_"
+)
+
+// shellArgVar prefixes the environment variables that override ARGs of the
+// exported script, so the environment of the script does not set them
+const shellArgVar = "MF_ARG_"
+
+// shellHelpers are the functions of the exported script, in the order they
+// are written
+var shellHelpers = []struct{ name, code string }{
+	{"machinefile_quote", `# machinefile_quote quotes a value as a single shell word
+machinefile_quote() {
+	printf "'%s'" "$(printf '%s' "$1" | sed "s/'/'\\\\''/g")"
+}`},
+	{"machinefile_exports", `# machinefile_exports prints the exports of the ARGs and ENVs that are set
+# for a step
+machinefile_exports() {
+	for name in "$@"; do
+		eval "[ \"\${mf_$name+set}\" = set ]" || continue
+		eval "value=\$mf_$name"
+		printf 'export %s=%s; ' "$name" "$(machinefile_quote "$value")"
+	done
+}`},
+	{"machinefile_run", `# machinefile_run runs a step with bash in the WORKDIR, as another user
+# through sudo
+machinefile_run() {
+	printf 'Executing command: %s\n' "$3"
+	script=$2
+	if [ -n "${machinefile_workdir-}" ]; then
+		script="${script}cd $(machinefile_quote "$machinefile_workdir") || exit; "
+	fi
+	if [ -z "$1" ] || [ "$1" = "$(id -un)" ]; then
+		bash -c "$script$3"
+		return
+	fi
+	user=${1%%:*}
+	case $user in *[!0-9]*) ;; *) user="#$user" ;; esac
+	case $1 in
+	*:*)
+		group=${1#*:}
+		case $group in *[!0-9]*) ;; *) group="#$group" ;; esac
+		sudo -u "$user" -g "$group" bash -c "$script$3"
+		;;
+	*)
+		sudo -u "$user" bash -c "$script$3"
+		;;
+	esac
+}`},
+	{"machinefile_chdir", `# machinefile_chdir creates the WORKDIR of later steps, relative to the
+# current one
+machinefile_chdir() {
+	case $1 in
+	/*) machinefile_workdir=$1 ;;
+	*) machinefile_workdir=${machinefile_workdir%/}/$1 ;;
+	esac
+	printf 'Changing to WORKDIR %s\n' "$machinefile_workdir"
+	mkdir -p "$machinefile_workdir"
+}`},
+	{"machinefile_file", `# machinefile_file writes a file of the context from base64 on stdin
+machinefile_file() {
+	mkdir -p "$(dirname "$1")"
+	base64 -d > "$1"
+	chmod "$2" "$1"
+	TZ=UTC0 touch -t "$3" "$1"
+}`},
+	{"machinefile_copy", `# machinefile_copy copies a source from the context to a destination like
+# COPY, or the contents of a directory like ADD
+machinefile_copy() {
+	dest=$3
+	case $dest in
+	/*) ;;
+	*) [ -z "${machinefile_workdir-}" ] || dest=${machinefile_workdir%/}/$dest ;;
+	esac
+	while [ "${dest%/}" != "$dest" ] && [ "$dest" != / ]; do dest=${dest%/}; done
+	if [ -d "$2" ] && [ "$1" = ADD ]; then
+		mkdir -p "$dest" && cp -a "$2"/* "$dest"/
+	elif [ -d "$2" ]; then
+		cp -a "$2" "$dest"
+	else
+		cp -p "$2" "$dest"
+	fi
+	printf '%s %s to %s\n' "$1" "$2" "$dest"
+}`},
+	{"machinefile_save", `# machinefile_save saves the ENVs of a stage for the stages built FROM it
+machinefile_save() {
+	stage=$1
+	shift
+	for name in "$@"; do
+		unset "mfs${stage}_$name"
+		eval "[ \"\${mfe_$name+set}\" = set ]" || continue
+		eval "mfs${stage}_$name=\$mf_$name"
+	done
+}`},
+	{"machinefile_restore", `# machinefile_restore sets the ENVs saved from a stage
+machinefile_restore() {
+	stage=$1
+	shift
+	for name in "$@"; do
+		eval "[ \"\${mfs${stage}_$name+set}\" = set ]" || continue
+		eval "mf_$name=\$mfs${stage}_$name mfe_$name=1"
+	done
+}`},
+	{"machinefile_truthy", `# machinefile_truthy succeeds unless a value is empty, 0 or false
+machinefile_truthy() {
+	case $1 in
+	"" | 0 | [Ff][Aa][Ll][Ss][Ee]) return 1 ;;
+	esac
+}`},
+	{"machinefile_compare", `# machinefile_vercmp prints -1, 0 or 1 comparing dotted versions numerically
+# by component, or as text for components that are not numbers
+machinefile_vercmp() {
+	a=$1 b=$2
+	while [ -n "$a$b" ]; do
+		pa=${a%%.*} pb=${b%%.*}
+		case $a in *.*) a=${a#*.} ;; *) a= ;; esac
+		case $b in *.*) b=${b#*.} ;; *) b= ;; esac
+		if expr "x$pa" : 'x[0-9][0-9]*$' >/dev/null && expr "x$pb" : 'x[0-9][0-9]*$' >/dev/null; then
+			[ "$pa" -lt "$pb" ] && { echo -1; return; }
+			[ "$pa" -gt "$pb" ] && { echo 1; return; }
+		elif [ "$pa" != "$pb" ]; then
+			if expr "x$pa" \< "x$pb" >/dev/null; then echo -1; else echo 1; fi
+			return
+		fi
+	done
+	echo 0
+}
+
+# machinefile_compare compares two values of a condition
+machinefile_compare() {
+	case $2 in
+	==) [ "$1" = "$3" ] ;;
+	!=) [ "$1" != "$3" ] ;;
+	=~) printf '%s\n' "$1" | grep -Eq -- "$3" ;;
+	!~) ! printf '%s\n' "$1" | grep -Eq -- "$3" ;;
+	*)
+		order=$(machinefile_vercmp "$1" "$3")
+		case $2 in
+		"<") [ "$order" -lt 0 ] ;;
+		"<=") [ "$order" -le 0 ] ;;
+		">") [ "$order" -gt 0 ] ;;
+		">=") [ "$order" -ge 0 ] ;;
+		esac
+		;;
+	esac
+}`},
+	{"machinefile_gather_facts", `# machinefile_os_release prints a value from the os-release file
+machinefile_os_release() {
+	(
+		for file in /etc/os-release /usr/lib/os-release; do
+			if [ -f "$file" ]; then
+				. "$file"
+				break
+			fi
+		done
+		eval "printf '%s' \"\${$1-}\""
+	)
+}
+
+# machinefile_gather_facts sets the facts about this machine used in
+# conditions and platform ARGs
+machinefile_gather_facts() {
+	facts=$(sh -c "$1")
+	fact() {
+		printf '%s\n' "$facts" | sed -n "s/^$1=//p" | head -n 1
+	}
+	machinefile_fact_hostname=$(fact hostname)
+	machinefile_fact_os=$(fact os | tr '[:upper:]' '[:lower:]')
+	machinefile_fact_kernel=$(fact kernel)
+	machine=$(fact machine)
+	machinefile_fact_variant=
+	case $machine in
+	x86_64 | amd64) machinefile_fact_arch=amd64 ;;
+	aarch64 | arm64) machinefile_fact_arch=arm64 ;;
+	armv8l | armv7l | armv7) machinefile_fact_arch=arm machinefile_fact_variant=v7 ;;
+	armv6l | armv6) machinefile_fact_arch=arm machinefile_fact_variant=v6 ;;
+	armv5tel | armv5l) machinefile_fact_arch=arm machinefile_fact_variant=v5 ;;
+	i386 | i486 | i586 | i686) machinefile_fact_arch=386 ;;
+	loongarch64) machinefile_fact_arch=loong64 ;;
+	*) machinefile_fact_arch=$machine ;;
+	esac
+	machinefile_fact_distro=$(machinefile_os_release ID)
+	machinefile_fact_distro_like=$(echo $(machinefile_os_release ID_LIKE))
+	machinefile_fact_distro_version=$(machinefile_os_release VERSION_ID)
+	machinefile_fact_cpus=$(fact cpus)
+	memory_kb=$(fact memory_kb)
+	machinefile_fact_memory_mb=$((${memory_kb:-0} / 1024))
+	machinefile_fact_package_manager=$(fact package_manager)
+	machinefile_fact_package_manager=${machinefile_fact_package_manager%-get}
+	machinefile_fact_init_system=$(fact init_system)
+	machinefile_fact_container=$(fact container)
+	machinefile_fact_is_container=false
+	[ -z "$machinefile_fact_container" ] || machinefile_fact_is_container=true
+	machinefile_fact_firewall=$(fact firewall)
+}`},
+	{"machinefile_healthcheck", `# machinefile_healthcheck runs a health check right away and then every
+# interval, until it passes or failed retries times after the start period
+machinefile_healthcheck() {
+	printf 'Verifying health (interval %ss, timeout %ss, start period %ss, retries %s)\n' "$4" "$5" "$6" "$7"
+	started=$(date +%s)
+	failures=0
+	attempt=1
+	while ! machinefile_run "$1" "$2" "$3"; do
+		if [ $(($(date +%s) - started)) -lt "$6" ]; then
+			echo "Health check failed during start period"
+		else
+			failures=$((failures + 1))
+			echo "Health check failed ($failures of $7)"
+			if [ "$failures" -ge "$7" ]; then
+				echo "target is unhealthy after $failures failed health checks" >&2
+				return 1
+			fi
+		fi
+		sleep "$4"
+		attempt=$((attempt + 1))
+	done
+	echo "Health check passed on attempt $attempt"
+}`},
+}
+
+// shellHelper returns the code of a helper function
+func shellHelper(name string) string {
+	for _, helper := range shellHelpers {
+		if helper.name == name {
+			return helper.code
+		}
+	}
+	return ""
+}
+
+// shellPlatformArgs are the built-in platform ARGs, set from the facts of the
+// machine the script runs on
+var shellPlatformArgs = []struct{ name, value string }{
+	{"TARGETOS", "$machinefile_fact_os"},
+	{"TARGETARCH", "$machinefile_fact_arch"},
+	{"TARGETVARIANT", "$machinefile_fact_variant"},
+	{"TARGETPLATFORM", "$machinefile_fact_os/$machinefile_fact_arch${machinefile_fact_variant:+/$machinefile_fact_variant}"},
+	{"BUILDPLATFORM", "$machinefile_fact_os/$machinefile_fact_arch"},
+	{"TARGET_HOSTNAME", "$machinefile_fact_hostname"},
+	{"TARGET_DISTRO_ID", "$machinefile_fact_distro"},
+	{"TARGET_DISTRO_VERSION", "$machinefile_fact_distro_version"},
+}
+
+// shellWord renders words of the Dockerfile as the contents of a double
+// quoted shell string, expanding variables from prefix when the script runs
+type shellWord struct {
+	prefix string
+	braces bool // The word is nested in a ${VAR-word} expansion
+}
+
+func (sw shellWord) literal(text string, nested bool) string {
+	special := "\\$\"`"
+	if nested || sw.braces {
+		special += "}"
+	}
+	var quoted strings.Builder
+	for _, ch := range text {
+		if strings.ContainsRune(special, ch) {
+			quoted.WriteRune('\\')
+		}
+		quoted.WriteRune(ch)
+	}
+	return quoted.String()
+}
+
+func (sw shellWord) variable(name, operator, word string, nested bool) string {
+	return "${" + sw.prefix + name + operator + word + "}"
+}
+
+// shellExporter compiles a Dockerfile into a POSIX shell script that runs the
+// steps the way the runners do. ARG values, USER and the other words are
+// expanded when the script runs, so ARGs can be overridden through the
+// environment.
+type shellExporter struct {
+	df      *Dockerfile
+	options ExportOptions
+	helpers map[string]bool
+	body    strings.Builder
+	files   strings.Builder
+	indent  string
+
+	// Current stage: its index, names of ARGs and ENVs, and names that may
+	// have been set by ENV
+	stage    int
+	names    map[string]bool
+	envNames map[string]bool
+	copies   int
+
+	healthchecks []string // Arguments of machinefile_healthcheck for each HEALTHCHECK
+	conditional  bool     // Some instructions have conditions
+
+	stages      map[string]int            // Index of named stages
+	stageEnvs   map[int]map[string]bool   // ENV names of stages, for stages built FROM them
+	staticVars  map[string]string         // Values of the stage at export time, for COPY sources
+	staticStage map[int]map[string]string // ENVs of stages at export time
+	globals     map[string]string         // Global ARGs at export time
+}
+
+// exportShell writes the Dockerfile as a standalone POSIX shell script
+func exportShell(df *Dockerfile, options ExportOptions) (string, error) {
+	e := &shellExporter{
+		df:          df,
+		options:     options,
+		helpers:     map[string]bool{"machinefile_quote": true, "machinefile_exports": true, "machinefile_run": true},
+		stage:       -1,
+		stages:      make(map[string]int),
+		stageEnvs:   make(map[int]map[string]bool),
+		staticStage: make(map[int]map[string]string),
+		globals:     make(map[string]string),
+	}
+	if !hasFrom(df.Instructions) {
+		e.startStage()
+	}
+	for k, v := range options.Args {
+		if builtinArgs[k] {
+			e.globals[k] = v
+		}
+	}
+
+	for _, inst := range df.Instructions {
+		if err := e.instruction(inst); err != nil {
+			return "", err
+		}
+	}
+	e.finish()
+	return e.script(), nil
+}
+
+// script assembles the header, helper functions, embedded files and steps
+func (e *shellExporter) script() string {
+	var script strings.Builder
+	source := e.options.Source
+	if source == "" {
+		source = "a Containerfile"
+	}
+	fmt.Fprintf(&script, "#!/bin/sh\n")
+	fmt.Fprintf(&script, "# Generated by machinefile %s from %s\n", e.options.Version, source)
+	fmt.Fprintf(&script, "#\n")
+	fmt.Fprintf(&script, "# Runs the steps on this machine like machinefile does: steps run with bash,\n")
+	fmt.Fprintf(&script, "# switching USER with sudo. ARGs can be overridden through the environment,\n")
+	fmt.Fprintf(&script, "# like %sNAME=value sh script.sh. No manifest is written.\n", shellArgVar)
+	fmt.Fprintf(&script, "set -e\n")
+
+	for _, helper := range shellHelpers {
+		if e.helpers[helper.name] {
+			script.WriteString("\n" + helper.code + "\n")
+		}
+	}
+
+	script.WriteString("\n")
+	if e.helpers["machinefile_gather_facts"] {
+		fmt.Fprintf(&script, "machinefile_gather_facts %s\n", shellQuote(factsScript))
+		for _, arg := range shellPlatformArgs {
+			if _, ok := e.options.Args[arg.name]; !ok {
+				fmt.Fprintf(&script, "%s%s=\"%s\"\n", shellGlobalVar, arg.name, arg.value)
+			}
+		}
+	}
+	for _, name := range sortedKeys(builtinArgs) {
+		if value, ok := e.options.Args[name]; ok {
+			fmt.Fprintf(&script, "%s%s=%s\n", shellGlobalVar, name, shellQuote(value))
+		}
+	}
+	if e.files.Len() > 0 {
+		script.WriteString("\nmachinefile_context=$(mktemp -d)\n")
+		script.WriteString("trap 'rm -rf \"$machinefile_context\"' EXIT\n")
+		script.WriteString(e.files.String())
+	}
+	if e.conditional {
+		script.WriteString("\nmachinefile_skipped=0\n")
+	}
+	script.WriteString(e.body.String())
+	return script.String()
+}
+
+// line writes a line of the body at the current indentation
+func (e *shellExporter) line(format string, args ...interface{}) {
+	e.body.WriteString(e.indent + fmt.Sprintf(format, args...) + "\n")
+}
+
+// word renders a word as a double quoted string expanded from the variables
+// in scope
+func (e *shellExporter) word(inst *Instruction, word string) (string, error) {
+	rendered, err := renderWord(word, e.df.EscapeToken, shellWord{prefix: e.varPrefix()})
+	if err != nil {
+		return "", fmt.Errorf("invalid %s command on line %d: %w", inst.Command, inst.Line, err)
+	}
+	return `"` + rendered + `"`, nil
+}
+
+func (e *shellExporter) varPrefix() string {
+	if e.stage < 0 {
+		return shellGlobalVar
+	}
+	return shellStageVar
+}
+
+func (e *shellExporter) instruction(inst *Instruction) error {
+	e.body.WriteString("\n# " + inst.String() + "\n")
+	if inst.When != "" {
+		if inst.Command == "FROM" {
+			return fmt.Errorf("FROM on line %d can not be conditional", inst.Line)
+		}
+		node, err := parseCondition(inst.When)
+		if err != nil {
+			return fmt.Errorf("error in condition on line %d: %w", inst.Line, err)
+		}
+		e.conditional = true
+		e.line("if %s; then", e.condition(node))
+		e.indent = "\t"
+		defer func() {
+			e.indent = ""
+			e.line("else")
+			e.line("\tprintf '%%s\\n' %s", shellQuote(fmt.Sprintf("Skipping %s on line %d, condition is false: %s", inst.Command, inst.Line, inst.When)))
+			e.line("\tmachinefile_skipped=$((machinefile_skipped + 1))")
+			e.line("fi")
+		}()
+	}
+
+	if inst.Command == "FROM" {
+		return e.from(inst)
+	}
+	if e.stage < 0 {
+		if inst.Command != "ARG" {
+			return fmt.Errorf("%s on line %d must follow FROM", inst.Command, inst.Line)
+		}
+		return e.arg(inst)
+	}
+
+	switch inst.Command {
+	case "RUN":
+		e.line("machinefile_run \"${machinefile_user-}\" \"$(machinefile_exports %s)\" %s", strings.Join(sortedKeys(e.names), " "), shellQuote(inst.Args))
+	case "COPY", "ADD":
+		return e.copy(inst)
+	case "USER":
+		user, err := e.word(inst, inst.Args)
+		if err != nil {
+			return err
+		}
+		e.line("machinefile_user=%s", user)
+		e.line("printf 'Switching to user: %%s\\n' \"$machinefile_user\"")
+	case "ENV":
+		return e.env(inst)
+	case "ARG":
+		return e.arg(inst)
+	case "VOLUME":
+		var volumes []string
+		words := splitWords(inst.Args, e.df.EscapeToken)
+		if list, ok := jsonList(inst.Args); ok {
+			words = list
+		}
+		for _, volume := range words {
+			word, err := e.word(inst, volume)
+			if err != nil {
+				return err
+			}
+			volumes = append(volumes, word)
+		}
+		if len(volumes) == 0 {
+			return fmt.Errorf("VOLUME on line %d requires at least one path", inst.Line)
+		}
+		e.line("mkdir -p %s", strings.Join(volumes, " "))
+	case "HEALTHCHECK":
+		check, err := parseHealthcheck(inst.Args)
+		if err != nil {
+			return fmt.Errorf("invalid HEALTHCHECK command on line %d: %w", inst.Line, err)
+		}
+		if check == nil {
+			e.line("machinefile_health=")
+			break
+		}
+		e.helpers["machinefile_healthcheck"] = true
+		e.healthchecks = append(e.healthchecks, fmt.Sprintf("%s %d %d %d %d",
+			shellQuote(check.script()), shellSeconds(check.Interval), shellSeconds(check.Timeout), int(math.Ceil(check.StartPeriod.Seconds())), check.Retries))
+		e.line("machinefile_health=%d", len(e.healthchecks))
+	case "WORKDIR":
+		workdir, err := e.word(inst, inst.Args)
+		if err != nil {
+			return err
+		}
+		e.helpers["machinefile_chdir"] = true
+		e.line("machinefile_chdir %s", workdir)
+	case "ENTRYPOINT", "CMD":
+		// Services are not installed by the script, so there is nothing for
+		// a health check to verify
+		e.line("machinefile_service=1")
+	case "EXPOSE", "LABEL", "STOPSIGNAL":
+		// Recorded for services, the firewall and the manifest, which the
+		// script does not install
+		e.line(": recorded for services and the manifest, not used by this script")
+	default:
+		e.line("printf '%%s\\n' %s", shellQuote("Unsupported command: "+inst.String()))
+	}
+	return nil
+}
+
+// from starts a stage, saving the ENVs of the previous stage and restoring
+// those of the stage it is built from
+func (e *shellExporter) from(inst *Instruction) error {
+	words, err := processWords(inst, e.globals, e.df.EscapeToken)
+	if err != nil {
+		return err
+	}
+	if len(words) != 1 && (len(words) != 3 || !strings.EqualFold(words[1], "AS")) {
+		return fmt.Errorf("invalid FROM command: %s", inst)
+	}
+
+	if e.stage >= 0 {
+		e.helpers["machinefile_save"] = true
+		e.line("machinefile_save %d %s", e.stage, strings.Join(sortedKeys(e.envNames), " "))
+		e.line("mfu%d=${machinefile_user-} mfh%d=${machinefile_health-} mfw%d=${machinefile_workdir-} mfc%d=${machinefile_service-}", e.stage, e.stage, e.stage, e.stage)
+		for _, name := range sortedKeys(e.names) {
+			e.line("unset %s%s mfe_%s", shellStageVar, name, name)
+		}
+	}
+	e.startStage()
+	e.line("machinefile_user= machinefile_health= machinefile_workdir= machinefile_service=")
+	if len(words) == 3 {
+		e.stages[strings.ToLower(words[2])] = e.stage
+	}
+	if parent, ok := e.stages[strings.ToLower(words[0])]; ok && parent != e.stage {
+		e.helpers["machinefile_restore"] = true
+		for name := range e.stageEnvs[parent] {
+			e.names[name] = true
+			e.envNames[name] = true
+		}
+		for k, v := range e.staticStage[parent] {
+			e.staticVars[k] = v
+		}
+		e.line("machinefile_restore %d %s", parent, strings.Join(sortedKeys(e.envNames), " "))
+		e.line("machinefile_user=$mfu%d machinefile_health=$mfh%d machinefile_workdir=$mfw%d machinefile_service=$mfc%d", parent, parent, parent, parent)
+	}
+	e.line("printf '%%s\\n' %s", shellQuote("Starting stage: FROM "+strings.Join(words, " ")))
+	return nil
+}
+
+func (e *shellExporter) startStage() {
+	e.stage++
+	e.names = make(map[string]bool)
+	e.envNames = make(map[string]bool)
+	e.staticVars = make(map[string]string)
+	e.stageEnvs[e.stage] = e.envNames
+	e.staticStage[e.stage] = make(map[string]string)
+}
+
+// arg sets ARGs from the export time value, an MF_ARG_NAME variable in the
+// environment, the default, the global ARG or the environment variable of
+// the same name, in that order, like the runners take them from the command
+// line, the file and the environment
+func (e *shellExporter) arg(inst *Instruction) error {
+	assignments, err := parseAssignments("ARG", inst.Args, nil, e.df.EscapeToken, false)
+	if err != nil {
+		return fmt.Errorf("invalid ARG command on line %d: %w", inst.Line, err)
+	}
+	words := splitWords(inst.Args, e.df.EscapeToken)
+	var names, values []string
+	for i, arg := range assignments {
+		target := shellWord{prefix: e.varPrefix(), braces: true}
+		var value string
+		if predefined, ok := e.options.Args[arg.Key]; ok {
+			value = "\"" + shellWord{prefix: e.varPrefix()}.literal(predefined, false) + "\""
+		} else if arg.HasValue {
+			_, raw, _ := strings.Cut(words[i], "=")
+			if value, err = renderWord(raw, e.df.EscapeToken, target); err != nil {
+				return fmt.Errorf("invalid ARG command on line %d: %w", inst.Line, err)
+			}
+			value = fmt.Sprintf("\"${%s%s-%s}\"", shellArgVar, arg.Key, value)
+		} else {
+			value = fmt.Sprintf("\"${%s%s-${%s%s-${%s-}}}\"", shellArgVar, arg.Key, shellGlobalVar, arg.Key, arg.Key)
+		}
+		names = append(names, arg.Key)
+		values = append(values, value)
+	}
+	e.assign(names, values, true)
+
+	// Track the values at export time for COPY sources
+	vars := e.globals
+	if e.stage >= 0 {
+		vars = e.staticVars
+	}
+	if staticArgs, err := parseAssignments("ARG", inst.Args, vars, e.df.EscapeToken, false); err == nil {
+		for _, arg := range staticArgs {
+			if value, ok := e.options.Args[arg.Key]; ok {
+				vars[arg.Key] = value
+			} else if arg.HasValue {
+				vars[arg.Key] = arg.Value
+			} else if _, ok := vars[arg.Key]; !ok {
+				vars[arg.Key] = e.globals[arg.Key]
+			}
+		}
+	}
+	if e.stage >= 0 {
+		for _, name := range names {
+			e.names[name] = true
+		}
+	}
+	return nil
+}
+
+func (e *shellExporter) env(inst *Instruction) error {
+	assignments, err := parseAssignments("ENV", inst.Args, e.staticVars, e.df.EscapeToken, true)
+	if err != nil {
+		return fmt.Errorf("invalid ENV command on line %d: %w", inst.Line, err)
+	}
+	words := splitWords(inst.Args, e.df.EscapeToken)
+	var names, values []string
+	for i, env := range assignments {
+		raw := strings.TrimPrefix(strings.TrimLeft(inst.Args, " \t"), env.Key)
+		if len(words) > 0 && strings.Contains(words[0], "=") {
+			_, raw, _ = strings.Cut(words[i], "=")
+		}
+		value, err := e.word(inst, strings.TrimSpace(raw))
+		if err != nil {
+			return err
+		}
+		names = append(names, env.Key)
+		values = append(values, value)
+		e.staticVars[env.Key] = env.Value
+		e.staticStage[e.stage][env.Key] = env.Value
+	}
+	e.assign(names, values, false)
+	for _, name := range names {
+		e.line("mfe_%s=1", name)
+		e.names[name] = true
+		e.envNames[name] = true
+	}
+	return nil
+}
+
+// assign sets variables of the current scope, expanding all values before
+// setting any of them. An ARG does not change a variable set by ENV, which
+// takes precedence in the stage.
+func (e *shellExporter) assign(names, values []string, isArg bool) {
+	if len(names) > 1 {
+		for i := range names {
+			e.line("machinefile_value%d=%s", i, values[i])
+			values[i] = fmt.Sprintf("$machinefile_value%d", i)
+		}
+	}
+	for i, name := range names {
+		guard := ""
+		if isArg && e.stage >= 0 && e.envNames[name] {
+			guard = fmt.Sprintf("[ -n \"${mfe_%s-}\" ] || ", name)
+		}
+		e.line("%s%s%s=%s", guard, e.varPrefix(), name, values[i])
+	}
+}
+
+// copy embeds the matches of a source in the script and copies them like
+// the runners do
+func (e *shellExporter) copy(inst *Instruction) error {
+	words := splitWords(inst.Args, e.df.EscapeToken)
+	if len(words) != 2 {
+		return fmt.Errorf("invalid %s command: %s", inst.Command, inst)
+	}
+	pattern, err := processWord(words[0], e.staticVars, e.df.EscapeToken)
+	if err != nil {
+		return fmt.Errorf("invalid %s command on line %d: %w", inst.Command, inst.Line, err)
+	}
+	dest, err := e.word(inst, words[1])
+	if err != nil {
+		return err
+	}
+	sources, err := readContextSources(e.options.ContextDir, pattern)
+	if err != nil {
+		return fmt.Errorf("error reading %s source on line %d: %w", inst.Command, inst.Line, err)
+	}
+
+	e.helpers["machinefile_file"] = true
+	e.helpers["machinefile_copy"] = true
+	e.copies++
+	for i, source := range sources {
+		dir := fmt.Sprintf("$machinefile_context/%d-%d", e.copies, i)
+		for _, file := range source.Files {
+			path := dir + "/" + source.Name
+			if file.Path != "." {
+				path += "/" + file.Path
+			}
+			path = `"` + path + `"`
+			switch {
+			case file.Target != "":
+				fmt.Fprintf(&e.files, "mkdir -p \"$(dirname %s)\" && ln -s %s %s\n", path, shellQuote(file.Target), path)
+			case file.Mode.IsDir():
+				fmt.Fprintf(&e.files, "mkdir -p %s && chmod %o %s\n", path, file.Mode.Perm(), path)
+			default:
+				fmt.Fprintf(&e.files, "machinefile_file %s %o %s <<'MACHINEFILE_EOF'\n%s\nMACHINEFILE_EOF\n",
+					path, file.Mode.Perm(), time.Unix(file.ModTime, 0).UTC().Format("200601021504.05"), wrapBase64(file.Content))
+			}
+		}
+		// Directories get their times after their contents are written
+		for _, file := range source.Files {
+			if file.Mode.IsDir() {
+				path := dir + "/" + source.Name
+				if file.Path != "." {
+					path += "/" + file.Path
+				}
+				fmt.Fprintf(&e.files, "TZ=UTC0 touch -t %s \"%s\"\n", time.Unix(file.ModTime, 0).UTC().Format("200601021504.05"), path)
+			}
+		}
+		e.line("machinefile_copy %s \"%s/%s\" %s", inst.Command, dir, source.Name, dest)
+	}
+	return nil
+}
+
+// condition compiles a parsed condition into a shell command that succeeds
+// when it is true
+func (e *shellExporter) condition(node *conditionNode) string {
+	e.helpers["machinefile_truthy"] = true
+	e.helpers["machinefile_compare"] = true
+	return e.conditionNode(node)
+}
+
+func (e *shellExporter) conditionNode(n *conditionNode) string {
+	switch n.Operator {
+	case "":
+		return "machinefile_truthy " + e.conditionValue(n)
+	case "!":
+		return "! " + e.conditionNode(n.Left)
+	case "||", "&&":
+		return fmt.Sprintf("{ %s %s %s; }", e.conditionNode(n.Left), n.Operator, e.conditionNode(n.Right))
+	}
+	return fmt.Sprintf("machinefile_compare %s %s %s", e.conditionValue(n.Left), shellQuote(n.Operator), e.conditionValue(n.Right))
+}
+
+// conditionValue renders the value of a node as a shell word
+func (e *shellExporter) conditionValue(n *conditionNode) string {
+	switch {
+	case n.Operator != "":
+		return fmt.Sprintf("\"$(if %s; then echo true; else echo false; fi)\"", e.conditionNode(n))
+	case n.Kind == conditionVariable:
+		return fmt.Sprintf("\"${%s%s-}\"", e.varPrefix(), n.Value)
+	case n.Kind == conditionFact:
+		e.helpers["machinefile_gather_facts"] = true
+		return "\"$machinefile_fact_" + n.Value + "\""
+	}
+	return shellQuote(n.Value)
+}
+
+// finish reports skipped steps and verifies the health check of the final
+// stage, unless it checks an ENTRYPOINT or CMD
+func (e *shellExporter) finish() {
+	if e.conditional {
+		e.body.WriteString("\n")
+		e.line("if [ \"$machinefile_skipped\" -gt 0 ]; then")
+		e.line("\techo \"Skipped $machinefile_skipped of %d instructions due to conditions\"", len(e.df.Instructions))
+		e.line("fi")
+	}
+	if len(e.healthchecks) > 0 && e.stage >= 0 {
+		e.body.WriteString("\n")
+		e.line("if [ -n \"${machinefile_health-}\" ] && [ -n \"${machinefile_service-}\" ]; then")
+		e.line("\techo \"Skipping HEALTHCHECK, ENTRYPOINT and CMD are not run by this script\"")
+		e.line("\tmachinefile_health=")
+		e.line("fi")
+		e.line("case ${machinefile_health-} in")
+		for i, check := range e.healthchecks {
+			e.line("%d) machinefile_healthcheck \"${machinefile_user-}\" \"$(machinefile_exports %s)\" %s ;;", i+1, strings.Join(sortedKeys(e.names), " "), check)
+		}
+		e.line("esac")
+	}
+
+	// Platform ARGs need the facts of the machine the script runs on
+	declared := e.df.DeclaredArgs()
+	for _, arg := range shellPlatformArgs {
+		if declared[arg.name] {
+			e.helpers["machinefile_gather_facts"] = true
+		}
+	}
+}
+
+// shellSeconds rounds a duration up to whole seconds, at least one
+func shellSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// wrapBase64 encodes content as base64 in lines of 76 characters
+func wrapBase64(content []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded)
+	return wrapped.String()
+}
+
+// jsonList returns the items of arguments in JSON array form
+func jsonList(args string) ([]string, bool) {
+	if !strings.HasPrefix(args, "[") {
+		return nil, false
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(args), &list); err != nil {
+		return nil, false
+	}
+	return list, true
+}
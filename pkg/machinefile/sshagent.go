@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHAgentKeys connects to the ssh-agent listening on socket and returns a
+// description of the keys it holds, so unusable agents are reported before
+// any step runs. Keys on security keys show up as sk-* types.
+func SSHAgentKeys(socket string) ([]string, error) {
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ssh-agent: %w", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("error listing ssh-agent keys: %w", err)
+	}
+
+	var descriptions []string
+	for _, key := range keys {
+		description := key.Format
+		if pub, err := ssh.ParsePublicKey(key.Blob); err == nil {
+			if _, ok := pub.(*ssh.Certificate); ok {
+				description += " certificate"
+			}
+		}
+		if key.Comment != "" {
+			description += " " + key.Comment
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions, nil
+}
+
+// certificateFor returns the OpenSSH certificate next to a private key, if any
+func certificateFor(keyPath string) string {
+	if keyPath == "" {
+		return ""
+	}
+	certPath := strings.TrimSuffix(keyPath, ".pub") + "-cert.pub"
+	if _, err := os.Stat(certPath); err != nil {
+		return ""
+	}
+	return certPath
+}
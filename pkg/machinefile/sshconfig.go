@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SSHConfig holds the Host sections of an OpenSSH client configuration
+type SSHConfig struct {
+	Path  string
+	hosts []sshConfigHost
+}
+
+type sshConfigHost struct {
+	patterns []string
+	options  [][2]string // keyword (lowercase) and value, in file order
+}
+
+// SSHHostConfig is the configuration that applies to a single target
+type SSHHostConfig struct {
+	Alias          string
+	HostName       string
+	Port           string
+	User           string
+	IdentityFiles  []string
+	IdentitiesOnly bool
+	ProxyJump      string
+}
+
+// DefaultSSHConfigPath returns the path of the user's OpenSSH client config
+func DefaultSSHConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "config")
+}
+
+// LoadSSHConfig reads an OpenSSH client config file, following Include
+// directives. Match blocks are not evaluated and never apply. A missing file
+// results in an empty configuration.
+func LoadSSHConfig(configPath string) (*SSHConfig, error) {
+	config := &SSHConfig{Path: configPath}
+	if configPath == "" {
+		return config, nil
+	}
+	if err := config.load(configPath, 0); err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *SSHConfig) load(configPath string, depth int) error {
+	if depth > 16 {
+		return fmt.Errorf("ssh config: too many nested includes in %s", configPath)
+	}
+
+	file, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Options before the first Host line apply to all hosts
+	current := &sshConfigHost{patterns: []string{"*"}}
+	flush := func() {
+		if len(current.options) > 0 || len(current.patterns) > 0 {
+			c.hosts = append(c.hosts, *current)
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		keyword, value := splitSSHConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			flush()
+			current = &sshConfigHost{patterns: strings.Fields(value)}
+		case "match":
+			flush()
+			current = &sshConfigHost{}
+		case "include":
+			flush()
+			for _, pattern := range strings.Fields(value) {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(DefaultSSHConfigPath()), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					if err := c.load(match, depth+1); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+				}
+			}
+			// Lines after an Include continue the enclosing section
+			current = &sshConfigHost{patterns: current.patterns}
+		default:
+			current.options = append(current.options, [2]string{keyword, value})
+		}
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading ssh config %s: %w", configPath, err)
+	}
+	return nil
+}
+
+// splitSSHConfigLine returns the lowercased keyword and value of a line,
+// accepting both "Keyword value" and "Keyword=value"
+func splitSSHConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	keyword := strings.ToLower(line[:i])
+	value := strings.TrimLeft(line[i:], " \t")
+	value = strings.TrimPrefix(value, "=")
+	value = strings.TrimSpace(value)
+	return keyword, strings.Trim(value, "\"")
+}
+
+// matches reports whether an alias matches the Host patterns of a section
+func (h sshConfigHost) matches(alias string) bool {
+	matched := false
+	for _, pattern := range h.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), alias)
+		if ok && negated {
+			return false
+		}
+		if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// HasHost reports whether the config has a Host section naming the alias
+// without wildcards, which identifies the alias as an SSH target
+func (c *SSHConfig) HasHost(alias string) bool {
+	for _, host := range c.hosts {
+		for _, pattern := range host.patterns {
+			if pattern == alias {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Resolve returns the settings for an alias. As with OpenSSH, the first
+// value obtained for each option is used, except for IdentityFile, which
+// accumulates.
+func (c *SSHConfig) Resolve(alias string) SSHHostConfig {
+	resolved := SSHHostConfig{Alias: alias}
+	seen := make(map[string]bool)
+	for _, host := range c.hosts {
+		if !host.matches(alias) {
+			continue
+		}
+		for _, option := range host.options {
+			keyword, value := option[0], option[1]
+			if keyword == "identityfile" {
+				resolved.IdentityFiles = append(resolved.IdentityFiles, expandSSHTokens(value, alias))
+				continue
+			}
+			if seen[keyword] {
+				continue
+			}
+			seen[keyword] = true
+			switch keyword {
+			case "hostname":
+				resolved.HostName = expandSSHTokens(value, alias)
+			case "port":
+				resolved.Port = value
+			case "user":
+				resolved.User = value
+			case "identitiesonly":
+				resolved.IdentitiesOnly = strings.EqualFold(value, "yes")
+			case "proxyjump":
+				if !strings.EqualFold(value, "none") {
+					resolved.ProxyJump = value
+				}
+			}
+		}
+	}
+	if resolved.HostName == "" {
+		resolved.HostName = alias
+	}
+	return resolved
+}
+
+// expandSSHTokens expands ~ and the %h and %% tokens supported in HostName
+// and IdentityFile
+func expandSSHTokens(value, alias string) string {
+	value = strings.ReplaceAll(value, "%%", "\x00")
+	value = strings.ReplaceAll(value, "%h", alias)
+	value = strings.ReplaceAll(value, "\x00", "%")
+	return expandHome(value)
+}
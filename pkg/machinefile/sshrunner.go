@@ -2,9 +2,12 @@ package internal
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,7 +26,9 @@ func getSSHAuth(sr *SSHRunner) []string {
 			os.Exit(1)
 		}
 		fmt.Println()
+		// Ask only once, later commands and copies reuse the password
 		sr.SshPassword = string(bytePassword)
+		sr.AskPassword = false
 	}
 	
 	if sr.SshPassword != "" {
@@ -43,44 +48,162 @@ func getSSHAuth(sr *SSHRunner) []string {
 	if sr.SshKeyPath != "" {
 		sshArgs = append(sshArgs, "-i", sr.SshKeyPath)
 	}
+
+	if sr.SshJump != "" {
+		sshArgs = append(sshArgs, "-J", sr.SshJump)
+	}
+
+	if sr.SshConfigPath != "" {
+		sshArgs = append(sshArgs, "-F", sr.SshConfigPath)
+	}
+
+	if sr.SshAgentSocket != "" {
+		sshArgs = append(sshArgs, "-o", "IdentityAgent="+sr.SshAgentSocket)
+	}
+
+	if certPath := sr.certPath(); certPath != "" {
+		sshArgs = append(sshArgs, "-o", "CertificateFile="+certPath)
+	}
+
+	if sr.ForwardAgent {
+		sshArgs = append(sshArgs, "-A")
+	}
 	
 	sshArgs = append(sshArgs, "-o", "StrictHostKeyChecking=no")
 	
 	return sshArgs
 }
 
-func (sr *SSHRunner) RunCommand(command string, userName string, envVars map[string]string) error {
-	expandedCommand := expandVariables(command, envVars)
-	sshCommand := expandedCommand
-	
-	if len(envVars) > 0 {
-		envPrefix := ""
-		for key, value := range envVars {
-			envPrefix += fmt.Sprintf("%s=%s ", key, value)
+// ParseJumpHosts validates a list of jump hosts in the form user@host[:port]
+// and returns them as a ProxyJump chain. Each value may itself be a comma
+// separated chain; hosts are connected to in the given order. IPv6 addresses
+// are given as [addr]:port, or bare without a port.
+func ParseJumpHosts(values []string) (string, error) {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop == "" {
+				continue
+			}
+			user, host := "", hop
+			if i := strings.LastIndex(host, "@"); i >= 0 {
+				if i == 0 {
+					return "", fmt.Errorf("invalid jump host %q: empty user", hop)
+				}
+				user, host = host[:i+1], host[i+1:]
+			}
+			port, hasPort := "", false
+			switch {
+			case strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]"):
+				host = host[1 : len(host)-1]
+			case strings.HasPrefix(host, "[") || strings.Count(host, ":") == 1:
+				h, p, err := net.SplitHostPort(host)
+				if err != nil {
+					return "", fmt.Errorf("invalid jump host %q: %w", hop, err)
+				}
+				host, port, hasPort = h, p, true
+			case strings.Contains(host, ":") && net.ParseIP(host) == nil:
+				return "", fmt.Errorf("invalid jump host %q: use [address]:port for IPv6 with a port", hop)
+			}
+			if hasPort {
+				if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+					return "", fmt.Errorf("invalid jump host %q: bad port %q", hop, port)
+				}
+			}
+			if host == "" {
+				return "", fmt.Errorf("invalid jump host %q: empty host", hop)
+			}
+			// ssh only reads an IPv6 address in brackets
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			if hasPort {
+				host += ":" + port
+			}
+			hops = append(hops, user+host)
 		}
-		sshCommand = envPrefix + sshCommand
 	}
+	return strings.Join(hops, ","), nil
+}
+
+func (sr *SSHRunner) RunCommand(command string, userName string, envVars map[string]string) error {
+	return sr.runCommand(command, userName, envVars, sr.become(), sr.WorkDir)
+}
+
+// runCommand runs a command on the remote host in workdir, switching users
+// with become. A nil become runs the command as the connecting user.
+func (sr *SSHRunner) runCommand(command string, userName string, envVars map[string]string, become *Become, workdir string) error {
+	// The remote shell and become methods do not pass on variables, so they
+	// are exported by the script itself
+	sshCommand := envExports(envVars) + workdirPrefix(workdir) + command
 	
-	if userName != "" {
-		sshCommand = fmt.Sprintf("sudo -u %s bash -c '%s'", userName, strings.Replace(sshCommand, "'", "'\"'\"'", -1))
+	interactive := false
+	var becomeArgv []string
+	if become != nil && become.targetUser(userName, sr.SshUser) != "" {
+		var preserveEnv []string
+		if sr.ForwardAgent {
+			// Keep the forwarded agent available to the step
+			preserveEnv = append(preserveEnv, "SSH_AUTH_SOCK")
+		}
+		argv, tty, err := become.command(userName, sr.SshUser, sshCommand, preserveEnv)
+		if err != nil {
+			return err
+		}
+		sshCommand = shellJoin(argv)
+		interactive = tty
+		becomeArgv = argv
 	}
 	
 	sshArgs := getSSHAuth(sr)
-	sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", sr.SshUser, sr.SshHost), sshCommand)
+	if interactive {
+		// doas and su only read passwords from a terminal
+		sshArgs = append(sshArgs, "-tt")
+	}
+	sshArgs = append(sshArgs, sr.target(), sshCommand)
 	
 	cmd := exec.Command(sshArgs[0], sshArgs[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = sr.stdout()
+	cmd.Stderr = sr.stderr()
 	
-	fmt.Printf("Executing remote command: %s\n", sshCommand)
-	err := cmd.Run()
+	fmt.Fprintf(sr.stdout(), "Executing remote command: %s\n", command)
+	var err error
+	if interactive {
+		err = sr.runInteractive(cmd, become.Password)
+	} else if becomeArgv != nil {
+		err = become.run(cmd, becomeArgv)
+	} else {
+		err = cmd.Run()
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error running remote command: %s, %v\n", command, err)
+		fmt.Fprintf(sr.stderr(), "Error running remote command: %s, %v\n", command, err)
 		return err
 	}
 	return nil
 }
 
+// runInteractive runs an ssh command with a remote terminal and answers the
+// password prompt of the become method
+func (sr *SSHRunner) runInteractive(cmd *exec.Cmd, password string) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = answerPasswordPrompt(stdout, stdin, sr.stdout(), password)
+	stdin.Close()
+	if werr := cmd.Wait(); werr != nil {
+		return werr
+	}
+	return err
+}
+
 func (sr *SSHRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
     srcPattern = filepath.Join(sr.BaseDir, srcPattern)
     srcPattern = filepath.Clean(srcPattern)
@@ -88,24 +211,24 @@ func (sr *SSHRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
     
     matches, err := filepath.Glob(srcPattern)
     if err != nil {
-        fmt.Fprintf(os.Stderr, "Error with glob pattern: %v\n", err)
+        fmt.Fprintf(sr.stderr(), "Error with glob pattern: %v\n", err)
         return err
     }
     
     if len(matches) == 0 {
-        fmt.Fprintf(os.Stderr, "No matches found for pattern: %s\n", srcPattern)
+        fmt.Fprintf(sr.stderr(), "No matches found for pattern: %s\n", srcPattern)
         return fmt.Errorf("no matches found")
     }
     
     for _, src := range matches {
         srcInfo, err := os.Stat(src)
         if err != nil {
-            fmt.Fprintf(os.Stderr, "Error stating source file: %v\n", err)
+            fmt.Fprintf(sr.stderr(), "Error stating source file: %v\n", err)
             return err
         }
         
         remoteTmpDir := fmt.Sprintf("/tmp/dockerfile-run-%d", time.Now().UnixNano())
-        err = sr.RunCommand(fmt.Sprintf("mkdir -p %s", remoteTmpDir), "", nil)
+        err = sr.runCommand(fmt.Sprintf("mkdir -p %s", remoteTmpDir), "", nil, nil, "")
         if err != nil {
             return err
         }
@@ -115,7 +238,7 @@ func (sr *SSHRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
         
         if sr.SshPassword != "" {
             if _, err := exec.LookPath("sshpass"); err != nil {
-                fmt.Fprintf(os.Stderr, "Error: sshpass is not installed. Please install it to use password authentication.\n")
+                fmt.Fprintf(sr.stderr(), "Error: sshpass is not installed. Please install it to use password authentication.\n")
                 os.Exit(1)
             }
             scpArgs = append(scpArgs, "sshpass", "-p", sr.SshPassword, "scp")
@@ -131,18 +254,35 @@ func (sr *SSHRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
             scpArgs = append(scpArgs, "-i", sr.SshKeyPath)
         }
         
+        // Add port and jump hosts if specified
+        if sr.SshPort != "" {
+            scpArgs = append(scpArgs, "-P", sr.SshPort)
+        }
+        if sr.SshJump != "" {
+            scpArgs = append(scpArgs, "-J", sr.SshJump)
+        }
+        if sr.SshConfigPath != "" {
+            scpArgs = append(scpArgs, "-F", sr.SshConfigPath)
+        }
+        if sr.SshAgentSocket != "" {
+            scpArgs = append(scpArgs, "-o", "IdentityAgent="+sr.SshAgentSocket)
+        }
+        if certPath := sr.certPath(); certPath != "" {
+            scpArgs = append(scpArgs, "-o", "CertificateFile="+certPath)
+        }
+        
         // Add -p flag to preserve file attributes
         scpArgs = append(scpArgs, "-p", "-r")
         
         // Add source and destination
-        scpArgs = append(scpArgs, src, fmt.Sprintf("%s@%s:%s/", sr.SshUser, sr.SshHost, remoteTmpDir))
+        scpArgs = append(scpArgs, src, fmt.Sprintf("%s:%s/", sr.target(), remoteTmpDir))
         
         scpCmd := exec.Command(scpArgs[0], scpArgs[1:]...)
-        scpCmd.Stdout = os.Stdout
-        scpCmd.Stderr = os.Stderr
+        scpCmd.Stdout = sr.stdout()
+        scpCmd.Stderr = sr.stderr()
         
         if err := scpCmd.Run(); err != nil {
-            fmt.Fprintf(os.Stderr, "Error copying file to remote host: %v\n", err)
+            fmt.Fprintf(sr.stderr(), "Error copying file to remote host: %v\n", err)
             return err
         }
         
@@ -156,16 +296,80 @@ func (sr *SSHRunner) CopyFile(srcPattern, dest string, isAdd bool) error {
             mvCommand = fmt.Sprintf("mkdir -p $(dirname %s) && cp -a %s %s && rm -rf %s", dest, remoteSrc, dest, remoteTmpDir)
         }
         
-        if err := sr.RunCommand(mvCommand, "", nil); err != nil {
+        if err := sr.runCommand(mvCommand, "", nil, sr.become(), ""); err != nil {
             return err
         }
         
         if isAdd {
-            fmt.Printf("Added contents of %s to %s on %s (preserving attributes)\n", src, dest, sr.SshHost)
+            fmt.Fprintf(sr.stdout(), "Added contents of %s to %s on %s (preserving attributes)\n", src, dest, sr.SshHost)
         } else {
-            fmt.Printf("Copied %s to %s on %s (preserving attributes)\n", src, dest, sr.SshHost)
+            fmt.Fprintf(sr.stdout(), "Copied %s to %s on %s (preserving attributes)\n", src, dest, sr.SshHost)
         }
     }
     
     return nil
 }
+
+func (sr *SSHRunner) resolveUser(spec UserSpec) (*Identity, error) {
+	return resolveWithGetent(spec, func(database string, keys ...string) ([]byte, error) {
+		return sr.output(shellJoin(append([]string{"getent", database}, keys...)), nil)
+	})
+}
+
+// output runs a command as the connecting user with input on stdin and
+// returns its stdout
+func (sr *SSHRunner) output(command string, input io.Reader) ([]byte, error) {
+	sshArgs := getSSHAuth(sr)
+	sshArgs = append(sshArgs, sr.target(), command)
+	cmd := exec.Command(sshArgs[0], sshArgs[1:]...)
+	cmd.Stdin = input
+	cmd.Stderr = sr.stderr()
+	return cmd.Output()
+}
+
+func (sr *SSHRunner) probe(script string, input io.Reader) ([]byte, error) {
+	return sr.output(script, input)
+}
+
+func (sr *SSHRunner) setWorkdir(dir string) {
+	sr.WorkDir = dir
+}
+
+func (sr *SSHRunner) become() *Become {
+	if sr.Become != nil {
+		return sr.Become
+	}
+	return defaultBecome
+}
+
+// certPath returns the certificate to authenticate with, defaulting to the
+// -cert.pub file next to the private key
+func (sr *SSHRunner) certPath() string {
+	if sr.SshCertPath != "" {
+		return sr.SshCertPath
+	}
+	return certificateFor(sr.SshKeyPath)
+}
+
+// target returns the destination passed to ssh and scp. Without a user, the
+// user from the ssh config or the local user name is used by ssh itself.
+func (sr *SSHRunner) target() string {
+	if sr.SshUser == "" {
+		return sr.SshHost
+	}
+	return fmt.Sprintf("%s@%s", sr.SshUser, sr.SshHost)
+}
+
+func (sr *SSHRunner) stdout() io.Writer {
+	if sr.Stdout != nil {
+		return sr.Stdout
+	}
+	return os.Stdout
+}
+
+func (sr *SSHRunner) stderr() io.Writer {
+	if sr.Stderr != nil {
+		return sr.Stderr
+	}
+	return os.Stderr
+}
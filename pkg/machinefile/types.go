@@ -1,20 +1,41 @@
 package internal
 
+import (
+	"io"
+)
+
 type Runner interface {
 	RunCommand(command string, userName string, envVars map[string]string) error
 	CopyFile(srcPattern, dest string, isAdd bool) error
 }
 
+// workdirRunner is implemented by runners that run steps in the WORKDIR of
+// the stage instead of the directory they start in
+type workdirRunner interface {
+	setWorkdir(dir string)
+}
+
 type LocalRunner struct {
 	BaseDir string
+	WorkDir string  // Working directory of steps, set by WORKDIR
+	Become  *Become // Defaults to switching USER with sudo
 }
 
 type SSHRunner struct {
-	BaseDir     string
-	SshHost     string
-	SshUser     string
-	SshPort     string
-	SshKeyPath  string
-	SshPassword string
-	AskPassword bool
+	BaseDir        string
+	SshHost        string
+	SshUser        string
+	SshPort        string
+	SshKeyPath     string
+	SshPassword    string
+	AskPassword    bool
+	SshJump        string    // ProxyJump chain, e.g. user@bastion:2222,other
+	SshConfigPath  string    // OpenSSH client config passed to ssh and scp with -F
+	SshCertPath    string    // OpenSSH certificate, defaults to <key>-cert.pub
+	SshAgentSocket string    // ssh-agent socket used for authentication, or none to use no agent
+	ForwardAgent   bool      // Forward the ssh-agent to the target
+	WorkDir        string    // Working directory of steps, set by WORKDIR
+	Become         *Become   // Defaults to switching USER with sudo
+	Stdout         io.Writer // Defaults to os.Stdout
+	Stderr         io.Writer // Defaults to os.Stderr
 }
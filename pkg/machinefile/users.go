@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UserSpec is the value of a USER instruction: user, uid, user:group or uid:gid
+type UserSpec struct {
+	User  string
+	Group string
+}
+
+func ParseUserSpec(value string) (UserSpec, error) {
+	value = strings.TrimSpace(value)
+	userPart, groupPart, hasGroup := strings.Cut(value, ":")
+	if userPart == "" || strings.ContainsAny(value, " \t") {
+		return UserSpec{}, fmt.Errorf("invalid USER %q, expected user[:group]", value)
+	}
+	if hasGroup && groupPart == "" {
+		return UserSpec{}, fmt.Errorf("invalid USER %q, empty group", value)
+	}
+	return UserSpec{User: userPart, Group: groupPart}, nil
+}
+
+func (us UserSpec) String() string {
+	if us.Group == "" {
+		return us.User
+	}
+	return us.User + ":" + us.Group
+}
+
+// Identity is a USER resolved against the account database of a target
+type Identity struct {
+	Name   string
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32 // Supplementary groups, including the primary group
+	Home   string
+}
+
+// userResolver is implemented by runners that validate USER against the
+// account database of their target
+type userResolver interface {
+	resolveUser(spec UserSpec) (*Identity, error)
+}
+
+// accountDB holds passwd and group entries of a target, split in fields
+type accountDB struct {
+	passwd [][]string // name:password:uid:gid:gecos:home:shell
+	group  [][]string // name:password:gid:members
+}
+
+func parseAccountDB(passwd, group []byte) *accountDB {
+	return &accountDB{
+		passwd: splitDBLines(passwd, 7),
+		group:  splitDBLines(group, 4),
+	}
+}
+
+func splitDBLines(data []byte, fields int) [][]string {
+	var entries [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := strings.Split(line, ":")
+		if len(entry) >= fields {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// loadRootfsAccounts reads the account database of a rootfs directory
+func loadRootfsAccounts(rootDir string) (*accountDB, error) {
+	passwdPath, err := resolveInRoot(rootDir, "/etc/passwd")
+	if err != nil {
+		return nil, fmt.Errorf("error reading passwd database: %w", err)
+	}
+	passwd, err := os.ReadFile(passwdPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading passwd database: %w", err)
+	}
+	// A missing group file only leaves groups unresolved
+	var group []byte
+	if groupPath, err := resolveInRoot(rootDir, "/etc/group"); err == nil {
+		group, _ = os.ReadFile(groupPath)
+	}
+	return parseAccountDB(passwd, group), nil
+}
+
+// resolve looks up a USER like the container runtimes do: numeric ids do not
+// need an entry, a user without an entry gets gid 0, and supplementary groups
+// are those listing the user as a member
+func (db *accountDB) resolve(spec UserSpec) (*Identity, error) {
+	identity := &Identity{Home: "/"}
+
+	found := false
+	for _, entry := range db.passwd {
+		if entry[0] == spec.User || entry[2] == spec.User {
+			uid, err := strconv.ParseUint(entry[2], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid uid for user %s: %w", entry[0], err)
+			}
+			gid, err := strconv.ParseUint(entry[3], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid for user %s: %w", entry[0], err)
+			}
+			identity.Name, identity.Uid, identity.Gid, identity.Home = entry[0], uint32(uid), uint32(gid), entry[5]
+			found = true
+			break
+		}
+	}
+	if !found {
+		uid, err := strconv.ParseUint(spec.User, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %s not found in passwd database", spec.User)
+		}
+		identity.Uid = uint32(uid)
+	}
+
+	if spec.Group != "" {
+		gid, err := db.lookupGroup(spec.Group)
+		if err != nil {
+			return nil, err
+		}
+		identity.Gid = gid
+	}
+
+	identity.Groups = []uint32{identity.Gid}
+	if identity.Name != "" {
+		for _, entry := range db.group {
+			if !containsString(strings.Split(entry[3], ","), identity.Name) {
+				continue
+			}
+			if gid, err := strconv.ParseUint(entry[2], 10, 32); err == nil && uint32(gid) != identity.Gid {
+				identity.Groups = append(identity.Groups, uint32(gid))
+			}
+		}
+	}
+	return identity, nil
+}
+
+func (db *accountDB) lookupGroup(group string) (uint32, error) {
+	for _, entry := range db.group {
+		if entry[0] == group || entry[2] == group {
+			gid, err := strconv.ParseUint(entry[2], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid gid for group %s: %w", entry[0], err)
+			}
+			return uint32(gid), nil
+		}
+	}
+	gid, err := strconv.ParseUint(group, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("group %s not found in group database", group)
+	}
+	return uint32(gid), nil
+}
+
+// resolveWithGetent resolves a USER with getent on the target, which also
+// covers accounts from NSS sources like LDAP. getent runs a getent command
+// for the given keys, or the whole database without keys, and returns its
+// output.
+func resolveWithGetent(spec UserSpec, getent func(database string, keys ...string) ([]byte, error)) (*Identity, error) {
+	passwd, err := getent("passwd", spec.User)
+	if err != nil && !isNumeric(spec.User) {
+		return nil, fmt.Errorf("user %s not found on target", spec.User)
+	}
+	// The whole group database is needed for the supplementary groups, so
+	// every runner sets the same groups as the chroot runner does
+	group, _ := getent("group")
+	if spec.Group != "" {
+		// Sources that do not enumerate, like LDAP, only answer by key
+		entry, err := getent("group", spec.Group)
+		if err != nil && !isNumeric(spec.Group) {
+			return nil, fmt.Errorf("group %s not found on target", spec.Group)
+		}
+		group = append(entry, group...)
+	}
+	return parseAccountDB(passwd, group).resolve(spec)
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func formatGroups(groups []uint32) string {
+	ids := make([]string, len(groups))
+	for i, gid := range groups {
+		ids[i] = strconv.FormatUint(uint64(gid), 10)
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// DefaultEscapeToken is the escape character used unless changed by a
+// parser directive
+const DefaultEscapeToken = '\\'
+
+// splitWords splits instruction arguments on whitespace outside of quotes.
+// Quotes and escapes are kept in the words, to be handled by processWord.
+func splitWords(s string, escapeToken rune) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, ch := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == escapeToken:
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case unicode.IsSpace(ch):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		}
+		inWord = true
+		word.WriteRune(ch)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// processWord removes quotes and escapes from a word and expands variables
+// like the Dockerfile shell lexer: single quotes are literal, in double quotes
+// only ", $ and the escape token can be escaped, and $VAR, ${VAR},
+// ${VAR:-default}, ${VAR-default}, ${VAR:+alternative}, ${VAR+alternative},
+// ${VAR:?message} and ${VAR?message} are expanded from envVars.
+func processWord(word string, envVars map[string]string, escapeToken rune) (string, error) {
+	lexer := &wordLexer{input: []rune(word), envVars: envVars, escapeToken: escapeToken}
+	return lexer.process()
+}
+
+// wordTarget renders a word as an expression of another language, like a
+// shell script, so variables are expanded where the word is used instead of
+// by machinefile
+type wordTarget interface {
+	// literal renders text, nested in the word of a ${VAR:-word} expansion
+	// when nested is true
+	literal(text string, nested bool) string
+	// variable renders the expansion of name, with the operator and rendered
+	// word of a ${VAR:-word} expansion when they are not empty
+	variable(name, operator, word string, nested bool) string
+}
+
+// renderWord renders a word like processWord does, but with quotes and
+// escapes removed by target and variables left for target to expand
+func renderWord(word string, escapeToken rune, target wordTarget) (string, error) {
+	lexer := &wordLexer{input: []rune(word), escapeToken: escapeToken, target: target}
+	return lexer.process()
+}
+
+type wordLexer struct {
+	input       []rune
+	pos         int
+	envVars     map[string]string
+	escapeToken rune
+	target      wordTarget
+	nested      int
+	pending     strings.Builder // Literal text not rendered for the target yet
+}
+
+// literal returns text as processed. For a target, text is collected until
+// flush renders it, so the target sees runs of text between variables.
+func (wl *wordLexer) literal(text string) string {
+	if wl.target == nil {
+		return text
+	}
+	wl.pending.WriteString(text)
+	return ""
+}
+
+// flush renders the collected literal text for the target
+func (wl *wordLexer) flush() string {
+	if wl.target == nil || wl.pending.Len() == 0 {
+		return ""
+	}
+	text := wl.pending.String()
+	wl.pending.Reset()
+	return wl.target.literal(text, wl.nested > 0)
+}
+
+func (wl *wordLexer) peek() rune {
+	if wl.pos >= len(wl.input) {
+		return 0
+	}
+	return wl.input[wl.pos]
+}
+
+func (wl *wordLexer) next() rune {
+	ch := wl.peek()
+	wl.pos++
+	return ch
+}
+
+func (wl *wordLexer) eof() bool {
+	return wl.pos >= len(wl.input)
+}
+
+func (wl *wordLexer) process() (string, error) {
+	return wl.processUntil(0)
+}
+
+// processUntil processes input until stop is found outside of quotes, which
+// is consumed. A stop of 0 processes all input.
+func (wl *wordLexer) processUntil(stop rune) (string, error) {
+	var result strings.Builder
+	for !wl.eof() {
+		ch := wl.peek()
+		switch {
+		case stop != 0 && ch == stop:
+			wl.next()
+			return result.String() + wl.flush(), nil
+		case ch == wl.escapeToken:
+			wl.next()
+			if wl.eof() {
+				// A trailing escape is kept literally
+				result.WriteString(wl.literal(string(ch)))
+			} else {
+				result.WriteString(wl.literal(string(wl.next())))
+			}
+		case ch == '\'':
+			wl.next()
+			value, err := wl.processSingleQuote()
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(value)
+		case ch == '"':
+			wl.next()
+			value, err := wl.processDoubleQuote()
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(value)
+		case ch == '$':
+			value, err := wl.processDollar()
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(value)
+		default:
+			result.WriteString(wl.literal(string(wl.next())))
+		}
+	}
+	if stop != 0 {
+		return "", fmt.Errorf("missing '%c' in %q", stop, string(wl.input))
+	}
+	return result.String() + wl.flush(), nil
+}
+
+func (wl *wordLexer) processSingleQuote() (string, error) {
+	var result strings.Builder
+	for !wl.eof() {
+		ch := wl.next()
+		if ch == '\'' {
+			return result.String(), nil
+		}
+		result.WriteString(wl.literal(string(ch)))
+	}
+	return "", fmt.Errorf("unexpected end of statement while looking for matching single-quote in %q", string(wl.input))
+}
+
+func (wl *wordLexer) processDoubleQuote() (string, error) {
+	var result strings.Builder
+	for !wl.eof() {
+		ch := wl.peek()
+		switch {
+		case ch == '"':
+			wl.next()
+			return result.String(), nil
+		case ch == '$':
+			value, err := wl.processDollar()
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(value)
+		case ch == wl.escapeToken:
+			wl.next()
+			switch escaped := wl.peek(); escaped {
+			case '"', '$', wl.escapeToken:
+				result.WriteString(wl.literal(string(wl.next())))
+			default:
+				result.WriteString(wl.literal(string(ch)))
+			}
+		default:
+			result.WriteString(wl.literal(string(wl.next())))
+		}
+	}
+	return "", fmt.Errorf("unexpected end of statement while looking for matching double-quote in %q", string(wl.input))
+}
+
+// processDollar expands a variable reference starting at $
+func (wl *wordLexer) processDollar() (string, error) {
+	wl.next() // $
+	if wl.peek() != '{' {
+		name := wl.processName()
+		if name == "" {
+			return wl.literal("$"), nil
+		}
+		if wl.target != nil {
+			return wl.flush() + wl.target.variable(name, "", "", wl.nested > 0), nil
+		}
+		return wl.envVars[name], nil
+	}
+
+	wl.next() // {
+	name := wl.processName()
+	if name == "" {
+		return "", fmt.Errorf("bad substitution in %q", string(wl.input))
+	}
+	if wl.peek() == '}' {
+		wl.next()
+		if wl.target != nil {
+			return wl.flush() + wl.target.variable(name, "", "", wl.nested > 0), nil
+		}
+		return wl.envVars[name], nil
+	}
+
+	operator := string(wl.next())
+	if operator == ":" {
+		operator += string(wl.next())
+	}
+	prefix := wl.flush()
+	wl.nested++
+	word, err := wl.processUntil('}')
+	wl.nested--
+	if err != nil {
+		return "", err
+	}
+	if wl.target != nil {
+		switch operator {
+		case ":-", "-", ":+", "+", ":?", "?":
+			return prefix + wl.target.variable(name, operator, word, wl.nested > 0), nil
+		}
+		return "", fmt.Errorf("unsupported modifier (%s) in substitution %q", operator, string(wl.input))
+	}
+
+	value, set := wl.envVars[name]
+	switch operator {
+	case ":-":
+		if value == "" {
+			return word, nil
+		}
+		return value, nil
+	case "-":
+		if !set {
+			return word, nil
+		}
+		return value, nil
+	case ":+":
+		if value != "" {
+			return word, nil
+		}
+		return "", nil
+	case "+":
+		if set {
+			return word, nil
+		}
+		return "", nil
+	case ":?":
+		if value == "" {
+			return "", fmt.Errorf("%s: %s", name, word)
+		}
+		return value, nil
+	case "?":
+		if !set {
+			return "", fmt.Errorf("%s: %s", name, word)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unsupported modifier (%s) in substitution %q", operator, string(wl.input))
+}
+
+func (wl *wordLexer) processName() string {
+	var name strings.Builder
+	for !wl.eof() {
+		ch := wl.peek()
+		if ch == '_' || unicode.IsLetter(ch) || (name.Len() > 0 && unicode.IsDigit(ch)) {
+			name.WriteRune(wl.next())
+			continue
+		}
+		break
+	}
+	return name.String()
+}
+
+// Assignment is a KEY=value pair from an ENV or ARG instruction. HasValue is
+// false for an ARG declared without a default.
+type Assignment struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+// parseAssignments parses the arguments of ENV or ARG. Values are processed
+// with processWord against envVars as they were before the instruction. When
+// allowLegacy is set, the "KEY value" form of ENV is accepted.
+func parseAssignments(instruction, args string, envVars map[string]string, escapeToken rune, allowLegacy bool) ([]Assignment, error) {
+	words := splitWords(args, escapeToken)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s requires at least one argument", instruction)
+	}
+
+	// Legacy form: ENV KEY value with spaces
+	if allowLegacy && !strings.Contains(words[0], "=") {
+		key := words[0]
+		rest := strings.TrimLeftFunc(strings.TrimPrefix(strings.TrimLeftFunc(args, unicode.IsSpace), key), unicode.IsSpace)
+		if rest == "" {
+			return nil, fmt.Errorf("%s %s must have two arguments", instruction, key)
+		}
+		value, err := processWord(rest, envVars, escapeToken)
+		if err != nil {
+			return nil, err
+		}
+		return []Assignment{{Key: key, Value: value, HasValue: true}}, nil
+	}
+
+	var assignments []Assignment
+	for _, word := range words {
+		key, rawValue, hasValue := strings.Cut(word, "=")
+		if key == "" {
+			return nil, fmt.Errorf("%s names can not be blank", instruction)
+		}
+		if !hasValue {
+			if allowLegacy {
+				return nil, fmt.Errorf("syntax error in %s: %q is missing '='", instruction, word)
+			}
+			assignments = append(assignments, Assignment{Key: key})
+			continue
+		}
+		value, err := processWord(rawValue, envVars, escapeToken)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, Assignment{Key: key, Value: value, HasValue: true})
+	}
+	return assignments, nil
+}